@@ -49,8 +49,11 @@ class Orchestrate_Runner extends \WP_CLI_Command {
 	 *
 	 * Not intended for human use, rather it powers the Go-based Runner. Use the `events run` command instead.
 	 *
+	 * With `--stdin`, the timestamp, action, and instance are read from a JSON object on stdin instead,
+	 * keeping them out of process listings.
+	 *
 	 * @subcommand run
-	 * @synopsis --timestamp=<timestamp> --action=<action-hashed> --instance=<instance>
+	 * @synopsis [--timestamp=<timestamp>] [--action=<action-hashed>] [--instance=<instance>] [--stdin]
 	 * @param array $args Array of positional arguments.
 	 * @param array $assoc_args Array of flags.
 	 */
@@ -59,6 +62,16 @@ class Orchestrate_Runner extends \WP_CLI_Command {
 			\WP_CLI::error( __( 'Automatic event execution is disabled', 'automattic-cron-control' ) );
 		}
 
+		if ( \WP_CLI\Utils\get_flag_value( $assoc_args, 'stdin', false ) ) {
+			$payload = json_decode( file_get_contents( 'php://stdin' ), true ); // phpcs:ignore WordPress.WP.AlternativeFunctions.file_get_contents_file_get_contents
+
+			if ( ! is_array( $payload ) ) {
+				\WP_CLI::error( __( 'Invalid event on stdin', 'automattic-cron-control' ) );
+			}
+
+			$assoc_args = array_merge( $assoc_args, array_intersect_key( $payload, array_flip( array( 'timestamp', 'action', 'instance' ) ) ) );
+		}
+
 		$timestamp = \WP_CLI\Utils\get_flag_value( $assoc_args, 'timestamp', null );
 		$action    = \WP_CLI\Utils\get_flag_value( $assoc_args, 'action', null );
 		$instance  = \WP_CLI\Utils\get_flag_value( $assoc_args, 'instance', null );
@@ -119,6 +132,7 @@ class Orchestrate_Runner extends \WP_CLI_Command {
 				'multisite' => is_multisite() ? 1 : 0,
 				'siteurl'   => site_url(),
 				'disabled'  => \Automattic\WP\Cron_Control\Events::instance()->run_disabled(),
+				'version'   => get_bloginfo( 'version' ),
 			),
 		);
 
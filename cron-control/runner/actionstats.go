@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type ActionCount struct {
+	Action    string `json:"action"`
+	Succeeded uint64 `json:"succeeded"`
+}
+
+// Successful runs per action since the last heartbeat, as *uint64
+var gActionSuccessCounts sync.Map
+
+func recordActionSuccess(action string) {
+	if heartbeatActionStats <= 0 {
+		return
+	}
+
+	count, found := gActionSuccessCounts.Load(action)
+	if !found {
+		count, _ = gActionSuccessCounts.LoadOrStore(action, new(uint64))
+	}
+	atomic.AddUint64(count.(*uint64), 1)
+}
+
+// topActionCounts resets the per-action counts, returning the -heartbeat-per-action-stats
+// actions with the most successful runs
+func topActionCounts() []ActionCount {
+	var counts []ActionCount
+	gActionSuccessCounts.Range(func(action, count interface{}) bool {
+		if n := atomic.SwapUint64(count.(*uint64), 0); n > 0 {
+			counts = append(counts, ActionCount{Action: action.(string), Succeeded: n})
+		}
+		return true
+	})
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Succeeded != counts[j].Succeeded {
+			return counts[i].Succeeded > counts[j].Succeeded
+		}
+		return counts[i].Action < counts[j].Action
+	})
+	if len(counts) > heartbeatActionStats {
+		counts = counts[:heartbeatActionStats]
+	}
+
+	return counts
+}
+
+func formatActionCounts(counts []ActionCount) string {
+	parts := make([]string, len(counts))
+	for i, c := range counts {
+		parts[i] = fmt.Sprintf("%s:%d", c.Action, c.Succeeded)
+	}
+	return fmt.Sprintf(" actions=[%s]", strings.Join(parts, ","))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+)
+
+var gActionTimeouts map[string]int
+
+// parseActionTimeouts reads the -event-action-timeout-map JSON map of action
+// globs to event timeouts in seconds
+func parseActionTimeouts() {
+	gActionTimeouts = make(map[string]int)
+	if "" == eventActionTimeouts {
+		return
+	}
+
+	if err := json.Unmarshal([]byte(eventActionTimeouts), &gActionTimeouts); err != nil {
+		fmt.Printf("Invalid action timeout map: %s\n", err.Error())
+		usage()
+	}
+
+	for glob, timeout := range gActionTimeouts {
+		if _, err := path.Match(glob, ""); err != nil {
+			fmt.Printf("Invalid action glob '%s': %s\n", glob, err.Error())
+			usage()
+		}
+		if timeout < 0 {
+			fmt.Printf("Invalid timeout %d for action glob '%s'\n", timeout, glob)
+			usage()
+		}
+	}
+}
+
+// actionTimeout returns the timeout in seconds for the action, using the longest
+// glob matching it and falling back to -event-timeout
+func actionTimeout(action string) int {
+	timeout := eventTimeout
+	longest := -1
+	for glob, t := range gActionTimeouts {
+		if matched, _ := path.Match(glob, action); matched && len(glob) > longest {
+			timeout, longest = t, len(glob)
+		}
+	}
+
+	return timeout
+}
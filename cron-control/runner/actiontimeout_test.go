@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestActionTimeout(t *testing.T) {
+	defer func(timeouts map[string]int, timeout int) {
+		gActionTimeouts, eventTimeout = timeouts, timeout
+	}(gActionTimeouts, eventTimeout)
+
+	eventTimeout = 600
+	gActionTimeouts = map[string]int{"wp_*": 60, "wp_update_*": 300, "wp_update_plugins": 0}
+
+	tests := []struct {
+		action  string
+		timeout int
+	}{
+		{"wp_update_plugins", 0},
+		{"wp_update_themes", 300},
+		{"wp_version_check", 60},
+		{"custom_action", 600},
+	}
+
+	for _, test := range tests {
+		if timeout := actionTimeout(test.action); timeout != test.timeout {
+			t.Errorf("actionTimeout(%q) = %d, expected %d", test.action, timeout, test.timeout)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+type CheckpointState struct {
+	InFlightEvents []event
+	RecentEvents   map[string]time.Time
+	LastSiteList   []site
+}
+
+var (
+	gLastSiteList      []site
+	gLastSiteListMutex = &sync.Mutex{}
+)
+
+func setLastSiteList(sites []site) {
+	gLastSiteListMutex.Lock()
+	gLastSiteList = sites
+	gLastSiteListMutex.Unlock()
+}
+
+// loadCheckpoint restores the dedup state saved by a previous runner
+func loadCheckpoint() {
+	if "" == checkpointFile {
+		return
+	}
+
+	raw, err := ioutil.ReadFile(checkpointFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logger.Printf("error reading checkpoint file %s: %s\n", checkpointFile, err.Error())
+		return
+	}
+
+	var state CheckpointState
+	if err = json.Unmarshal(raw, &state); err != nil {
+		logger.Printf("error parsing checkpoint file %s: %s\n", checkpointFile, err.Error())
+		return
+	}
+
+	// Events that were still running when the previous runner died never completed, so they
+	// are not suppressed and will run again when get-events returns them
+	restored := gEventTracker.Restore(state.RecentEvents)
+	setLastSiteList(state.LastSiteList)
+	logger.Printf("restored checkpoint with %d recent event(s) and %d site(s), %d interrupted event(s) will be rerun", restored, len(state.LastSiteList), len(state.InFlightEvents))
+}
+
+func writeCheckpoint() error {
+	gLastSiteListMutex.Lock()
+	state := CheckpointState{
+		InFlightEvents: gEventTracker.InFlight(),
+		RecentEvents:   gEventTracker.Recent(),
+		LastSiteList:   gLastSiteList,
+	}
+	buf, err := json.Marshal(state)
+	gLastSiteListMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(checkpointFile, buf)
+}
+
+// writeFileAtomic writes to a temporary file first so a crash never leaves a partial file
+func writeFileAtomic(fileName string, buf []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(fileName), path.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fileName)
+}
+
+func checkpointPeriodically(ctx context.Context) {
+	if "" == checkpointFile {
+		return
+	}
+	if checkpointInterval < 1 {
+		logger.Printf("invalid checkpoint interval %d, checkpoints disabled\n", checkpointInterval)
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(checkpointInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := writeCheckpoint(); err != nil {
+				logger.Printf("error writing checkpoint file %s: %s\n", checkpointFile, err.Error())
+			}
+		}
+	}
+}
+
+func removeCheckpoint() {
+	if "" == checkpointFile {
+		return
+	}
+
+	if err := os.Remove(checkpointFile); err != nil && !os.IsNotExist(err) {
+		logger.Printf("error removing checkpoint file %s: %s\n", checkpointFile, err.Error())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	defer func(file string, tracker *EventTracker, l *Logger) {
+		checkpointFile, gEventTracker, logger = file, tracker, l
+	}(checkpointFile, gEventTracker, logger)
+
+	logger = &Logger{FileName: "os.Stdout", Type: Text}
+	logger.Init()
+	checkpointFile = filepath.Join(t.TempDir(), "checkpoint.json")
+
+	finished := event{URL: "https://example.com", Timestamp: 1, Action: "finished"}
+	interrupted := event{URL: "https://example.com", Timestamp: 1, Action: "interrupted"}
+
+	gEventTracker = newTestEventTracker()
+	gEventTracker.Start(finished)
+	gEventTracker.Finish(finished, true)
+	gEventTracker.Start(interrupted)
+	finishedAt := gEventTracker.Recent()[eventKey(finished)]
+
+	if err := writeCheckpoint(); err != nil {
+		t.Fatalf("writeCheckpoint: %s", err.Error())
+	}
+
+	gEventTracker = newTestEventTracker()
+	loadCheckpoint()
+
+	restoredAt, found := gEventTracker.Recent()[eventKey(finished)]
+	if !found {
+		t.Fatal("finished event was not restored")
+	}
+	if !restoredAt.Equal(finishedAt) {
+		t.Errorf("finished event restored with time %s, expected %s", restoredAt, finishedAt)
+	}
+	if gEventTracker.Start(finished) {
+		t.Error("Start returned true for a finished event after restoring the checkpoint")
+	}
+	if !gEventTracker.Start(interrupted) {
+		t.Error("Start returned false for an interrupted event after restoring the checkpoint")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const cloudMetadataTimeout = 2 * time.Second
+
+// gLabels are the -instance-label and -cloud-metadata-url labels, added to JSON logs,
+// heartbeats and Slack posts
+var gLabels map[string]string
+
+// fetchCloudLabels reads instance labels from a metadata endpoint returning a flat JSON object,
+// the runner starts without them if the endpoint can't be read
+func fetchCloudLabels() {
+	if "" == cloudMetadataURL {
+		return
+	}
+
+	labels, err := readCloudMetadata()
+	if err != nil {
+		logger.Printf("WARNING: could not fetch instance labels from %s: %s\n", cloudMetadataURL, err.Error())
+		return
+	}
+
+	if nil == gLabels {
+		gLabels = make(map[string]string, len(labels))
+	}
+	for key, value := range labels {
+		// -instance-label takes precedence
+		if _, found := gLabels[key]; !found {
+			gLabels[key] = value
+		}
+	}
+	logger.Labels = gLabels
+	logger.Printf("Loaded %d instance label(s) from %s", len(labels), cloudMetadataURL)
+}
+
+func readCloudMetadata() (map[string]string, error) {
+	client := &http.Client{Timeout: cloudMetadataTimeout}
+	resp, err := client.Get(cloudMetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if http.StatusOK != resp.StatusCode {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string)
+	if err = json.Unmarshal(raw, &labels); err != nil {
+		return nil, err
+	}
+
+	return labels, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+type DeadLetterEntry struct {
+	Time      string `json:"time"`
+	Site      string `json:"site"`
+	Action    string `json:"action"`
+	Instance  string `json:"instance"`
+	Timestamp int    `json:"timestamp"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+}
+
+var gDeadLetterMutex = &sync.Mutex{}
+
+// writeDeadLetter appends an event that failed all of its attempts to the dead-letter log
+func writeDeadLetter(e event, lastErr error) {
+	if "" == deadLetterLog {
+		return
+	}
+
+	buf, err := json.Marshal(DeadLetterEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Site:      redactSiteURLs(e.URL),
+		Action:    e.Action,
+		Instance:  e.Instance,
+		Timestamp: e.Timestamp,
+		Attempts:  e.Attempts + 1,
+		LastError: redactSiteURLs(lastErr.Error()),
+	})
+	if err != nil {
+		logger.Printf("error encoding dead-letter entry: %s\n", err.Error())
+		return
+	}
+
+	gDeadLetterMutex.Lock()
+	defer gDeadLetterMutex.Unlock()
+
+	f, err := os.OpenFile(deadLetterLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		logger.Printf("error opening dead-letter log %s: %s\n", deadLetterLog, err.Error())
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(buf, '\n')); err != nil {
+		logger.Printf("error writing dead-letter log %s: %s\n", deadLetterLog, err.Error())
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const eventDedupTTL = 10 * time.Minute
+
+// EventTracker remembers which events are running or have recently finished
+// so that the same event is not run twice
+type EventTracker struct {
+	inFlight map[string]inFlightEvent
+	recent   map[string]time.Time
+	mutex    sync.Mutex
+}
+
+type inFlightEvent struct {
+	event   event
+	started time.Time
+}
+
+var gEventTracker = &EventTracker{inFlight: make(map[string]inFlightEvent), recent: make(map[string]time.Time)}
+
+func eventKey(e event) string {
+	return fmt.Sprintf("%d|%s|%s|%s", e.Timestamp, e.Action, e.Instance, e.URL)
+}
+
+// Start marks an event as in-flight, returning false if it is already running
+// or finished within the dedup window
+func (self *EventTracker) Start(e event) bool {
+	key := eventKey(e)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if _, running := self.inFlight[key]; running {
+		return false
+	}
+	if seen, found := self.recent[key]; found {
+		if time.Since(seen) < eventDedupTTL {
+			return false
+		}
+		delete(self.recent, key)
+	}
+
+	self.inFlight[key] = inFlightEvent{event: e, started: time.Now()}
+	return true
+}
+
+// Finish clears an in-flight event. With -checkpoint-file, it is also remembered for
+// the dedup window unless it is going to be retried, so a restart doesn't rerun it
+func (self *EventTracker) Finish(e event, remember bool) {
+	key := eventKey(e)
+
+	self.mutex.Lock()
+	delete(self.inFlight, key)
+	if remember && "" != checkpointFile {
+		self.recent[key] = time.Now()
+	}
+	self.mutex.Unlock()
+}
+
+// Recent returns a copy of the recently finished events and when they finished
+func (self *EventTracker) Recent() map[string]time.Time {
+	self.mutex.Lock()
+	recent := make(map[string]time.Time, len(self.recent))
+	for key, finished := range self.recent {
+		recent[key] = finished
+	}
+	self.mutex.Unlock()
+
+	return recent
+}
+
+// Restore remembers events finished by a previous runner, keeping their original finish
+// times so the dedup window counts from when they really finished
+func (self *EventTracker) Restore(recent map[string]time.Time) int {
+	restored := 0
+
+	self.mutex.Lock()
+	for key, finished := range recent {
+		if time.Since(finished) >= eventDedupTTL {
+			continue
+		}
+		self.recent[key] = finished
+		restored++
+	}
+	self.mutex.Unlock()
+
+	return restored
+}
+
+func (self *EventTracker) InFlight() []event {
+	self.mutex.Lock()
+	events := make([]event, 0, len(self.inFlight))
+	for _, running := range self.inFlight {
+		events = append(events, running.event)
+	}
+	self.mutex.Unlock()
+
+	return events
+}
+
+// Sweep expires in-flight entries older than -event-dedup-ttl every -event-dedup-sweep-interval,
+// so an event whose worker never called Finish can run again, and drops expired recent entries
+func (self *EventTracker) Sweep(ctx context.Context) {
+	interval := time.Duration(eventDedupSweepInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ttl := time.Duration(eventDedupInFlightTTL) * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		self.mutex.Lock()
+		for key, running := range self.inFlight {
+			if ttl <= 0 || time.Since(running.started) < ttl {
+				continue
+			}
+			delete(self.inFlight, key)
+			if debug {
+				logger.Printf("expired in-flight job %s after %s", key, time.Since(running.started).Round(time.Second))
+			}
+		}
+		self.prune()
+		self.mutex.Unlock()
+	}
+}
+
+// prune drops expired entries, callers must hold the mutex
+func (self *EventTracker) prune() {
+	for key, seen := range self.recent {
+		if time.Since(seen) >= eventDedupTTL {
+			delete(self.recent, key)
+		}
+	}
+}
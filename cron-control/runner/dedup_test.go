@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestEventTracker() *EventTracker {
+	return &EventTracker{inFlight: make(map[string]inFlightEvent), recent: make(map[string]time.Time)}
+}
+
+func TestEventTrackerStart(t *testing.T) {
+	defer func(saved string) { checkpointFile = saved }(checkpointFile)
+
+	e := event{URL: "https://example.com", Timestamp: 1, Action: "action", Instance: "instance"}
+	tests := []struct {
+		name           string
+		checkpointFile string
+		remember       bool
+		startAgain     bool
+	}{
+		{"retried", "", false, true},
+		{"finished without checkpoint", "", true, true},
+		{"finished with checkpoint", "/tmp/checkpoint.json", true, false},
+		{"retried with checkpoint", "/tmp/checkpoint.json", false, true},
+	}
+
+	for _, test := range tests {
+		checkpointFile = test.checkpointFile
+		tracker := newTestEventTracker()
+
+		if !tracker.Start(e) {
+			t.Fatalf("%s: first Start returned false", test.name)
+		}
+		if tracker.Start(e) {
+			t.Errorf("%s: Start returned true for an in-flight event", test.name)
+		}
+
+		tracker.Finish(e, test.remember)
+		if started := tracker.Start(e); started != test.startAgain {
+			t.Errorf("%s: Start after Finish returned %v, expected %v", test.name, started, test.startAgain)
+		}
+	}
+}
+
+func TestEventTrackerRestore(t *testing.T) {
+	recent := event{URL: "https://example.com", Timestamp: 1, Action: "recent"}
+	expired := event{URL: "https://example.com", Timestamp: 1, Action: "expired"}
+
+	tracker := newTestEventTracker()
+	restored := tracker.Restore(map[string]time.Time{
+		eventKey(recent):  time.Now().Add(-time.Minute),
+		eventKey(expired): time.Now().Add(-eventDedupTTL - time.Minute),
+	})
+	if 1 != restored {
+		t.Errorf("Restore returned %d, expected 1", restored)
+	}
+
+	if tracker.Start(recent) {
+		t.Error("Start returned true for an event finished within the dedup window")
+	}
+	if !tracker.Start(expired) {
+		t.Error("Start returned false for an event finished before the dedup window")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	gEventRunEnv      []string
+	gEventRunEnvMutex = &sync.RWMutex{}
+)
+
+// loadEventRunEnv reads -event-run-env-file's KEY=VALUE lines, skipping blank lines and
+// `#` comments. A missing file clears the variables.
+func loadEventRunEnv() {
+	if "" == eventRunEnvFile {
+		return
+	}
+
+	env := make([]string, 0)
+	f, err := os.Open(eventRunEnvFile)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Printf("error reading event environment file %s: %s\n", eventRunEnvFile, err.Error())
+		return
+	}
+	if err == nil {
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			entry := strings.TrimSpace(scanner.Text())
+			if "" == entry || strings.HasPrefix(entry, "#") {
+				continue
+			}
+
+			// Only the first `=` separates the key, values may contain more
+			parts := strings.SplitN(entry, "=", 2)
+			if 2 != len(parts) || "" == strings.TrimSpace(parts[0]) {
+				logger.Printf("WARNING: skipping invalid line %d of event environment file %s\n", line, eventRunEnvFile)
+				continue
+			}
+			env = append(env, strings.TrimSpace(parts[0])+"="+parts[1])
+		}
+		if err = scanner.Err(); err != nil {
+			logger.Printf("error reading event environment file %s: %s\n", eventRunEnvFile, err.Error())
+			return
+		}
+	}
+
+	gEventRunEnvMutex.Lock()
+	gEventRunEnv = env
+	gEventRunEnvMutex.Unlock()
+	logger.Printf("Loaded %d variable(s) from event environment file %s", len(env), eventRunEnvFile)
+}
+
+func eventRunEnv() []string {
+	gEventRunEnvMutex.RLock()
+	defer gEventRunEnvMutex.RUnlock()
+
+	return gEventRunEnv
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// WpCliExitError is returned when WP-CLI ran but exited with a non-zero code
+type WpCliExitError struct {
+	Code   int
+	Output string
+}
+
+func (self *WpCliExitError) Error() string {
+	return fmt.Sprintf("WP-CLI exited with code %d", self.Code)
+}
+
+// WpCliTimeoutError is returned when WP-CLI was killed for running too long
+type WpCliTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (self *WpCliTimeoutError) Error() string {
+	return fmt.Sprintf("WP-CLI killed after exceeding the %s timeout", self.Timeout)
+}
+
+// WpCliNotFoundError is returned when the WP-CLI (or PHP, sudo) binary could not be started
+type WpCliNotFoundError struct {
+	Err error
+}
+
+func (self *WpCliNotFoundError) Error() string {
+	return fmt.Sprintf("WP-CLI could not be started: %s", self.Err.Error())
+}
+
+func (self *WpCliNotFoundError) Unwrap() error {
+	return self.Err
+}
+
+// classifyWpCliError maps the error from running WP-CLI to one of the types above
+func classifyWpCliError(ctx context.Context, err error, timeout time.Duration, output []byte) error {
+	if nil == err {
+		return nil
+	}
+
+	if context.DeadlineExceeded == ctx.Err() {
+		return &WpCliTimeoutError{Timeout: timeout}
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &WpCliExitError{Code: exitErr.ExitCode(), Output: string(output)}
+	}
+
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		return &WpCliNotFoundError{Err: err}
+	}
+
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type EventRunEntry struct {
+	Time       string `json:"time"`
+	Site       string `json:"site"`
+	Action     string `json:"action"`
+	Instance   string `json:"instance"`
+	Timestamp  int    `json:"timestamp"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+var eventLogCSVHeader = []string{"time", "site", "action", "instance", "timestamp", "status", "error", "duration_ms"}
+
+var (
+	gEventLog      *os.File
+	gEventLogCSV   *csv.Writer
+	gEventLogMutex = &sync.Mutex{}
+)
+
+func openEventLog() {
+	if "json" != eventLogFormat && "csv" != eventLogFormat {
+		fmt.Printf("Invalid event log format '%s'\n", eventLogFormat)
+		usage()
+	}
+	if "" == eventLog {
+		return
+	}
+
+	var err error
+	if gEventLog, err = os.OpenFile(eventLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666); err != nil {
+		fmt.Printf("Error opening the event log: %s\n", err.Error())
+		os.Exit(3)
+	}
+
+	if "csv" == eventLogFormat {
+		gEventLogCSV = csv.NewWriter(gEventLog)
+		// Only new files get a header, appending to an existing log keeps it a single table
+		if stat, err := gEventLog.Stat(); err == nil && 0 == stat.Size() {
+			gEventLogCSV.Write(eventLogCSVHeader)
+			gEventLogCSV.Flush()
+		}
+	}
+}
+
+// writeEventRun records the outcome of one event run
+func writeEventRun(e event, runErr error, duration time.Duration) {
+	if nil == gEventLog {
+		return
+	}
+
+	entry := EventRunEntry{
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		Site:       redactSiteURLs(e.URL),
+		Action:     e.Action,
+		Instance:   e.Instance,
+		Timestamp:  e.Timestamp,
+		Status:     "success",
+		DurationMs: duration.Milliseconds(),
+	}
+	if nil != runErr {
+		entry.Status, entry.Error = "error", redactSiteURLs(runErr.Error())
+	}
+
+	gEventLogMutex.Lock()
+	defer gEventLogMutex.Unlock()
+
+	if nil == gEventLog {
+		return
+	}
+
+	var err error
+	if nil != gEventLogCSV {
+		gEventLogCSV.Write([]string{entry.Time, entry.Site, entry.Action, entry.Instance, strconv.Itoa(entry.Timestamp),
+			entry.Status, entry.Error, strconv.FormatInt(entry.DurationMs, 10)})
+		gEventLogCSV.Flush()
+		err = gEventLogCSV.Error()
+	} else {
+		var buf []byte
+		if buf, err = json.Marshal(entry); err == nil {
+			_, err = gEventLog.Write(append(buf, '\n'))
+		}
+	}
+	if err != nil {
+		logger.Printf("error writing event log %s: %s\n", eventLog, err.Error())
+	}
+}
+
+func closeEventLog() {
+	gEventLogMutex.Lock()
+	defer gEventLogMutex.Unlock()
+
+	if nil != gEventLog {
+		gEventLog.Close()
+		gEventLog, gEventLogCSV = nil, nil
+	}
+}
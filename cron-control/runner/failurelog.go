@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type GetEventsFailureEntry struct {
+	Time          string `json:"time"`
+	Site          string `json:"site"`
+	Error         string `json:"error"`
+	WpCliExitCode int    `json:"wpcli_exit_code"`
+}
+
+var (
+	gFailureLog      *os.File
+	gFailureLogMutex = &sync.Mutex{}
+)
+
+func openGetEventsFailureLog() {
+	if "" == getEventsFailureLog {
+		return
+	}
+
+	var err error
+	if gFailureLog, err = os.OpenFile(getEventsFailureLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666); err != nil {
+		fmt.Printf("Error opening the event retrieval failure log: %s\n", err.Error())
+		os.Exit(3)
+	}
+}
+
+// writeGetEventsFailure records a failed `list-due-batch` call, with an exit code of
+// `-1` when WP-CLI didn't exit on its own
+func writeGetEventsFailure(site string, failure error) {
+	if nil == gFailureLog {
+		return
+	}
+
+	exitCode := -1
+	if exitErr, ok := failure.(*WpCliExitError); ok {
+		exitCode = exitErr.Code
+	}
+
+	buf, err := json.Marshal(GetEventsFailureEntry{
+		Time:          time.Now().UTC().Format(time.RFC3339),
+		Site:          redactSiteURLs(site),
+		Error:         redactSiteURLs(failure.Error()),
+		WpCliExitCode: exitCode,
+	})
+	if err != nil {
+		logger.Printf("error encoding event retrieval failure: %s\n", err.Error())
+		return
+	}
+
+	gFailureLogMutex.Lock()
+	defer gFailureLogMutex.Unlock()
+
+	if nil == gFailureLog {
+		return
+	}
+	if _, err = gFailureLog.Write(append(buf, '\n')); err != nil {
+		logger.Printf("error writing event retrieval failure log %s: %s\n", getEventsFailureLog, err.Error())
+	}
+}
+
+func closeGetEventsFailureLog() {
+	gFailureLogMutex.Lock()
+	defer gFailureLogMutex.Unlock()
+
+	if nil != gFailureLog {
+		gFailureLog.Close()
+		gFailureLog = nil
+	}
+}
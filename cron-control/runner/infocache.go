@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// writeInfoCacheFile saves the latest instance info for -get-info-cache-file
+func writeInfoCacheFile(info siteInfo) {
+	if "" == getInfoCacheFile {
+		return
+	}
+
+	buf, err := json.Marshal(info)
+	if err == nil {
+		err = writeFileAtomic(getInfoCacheFile, buf)
+	}
+	if err != nil {
+		logger.Printf("error writing instance info cache %s: %s\n", getInfoCacheFile, err.Error())
+	}
+}
+
+// readInfoCacheFile loads the instance info saved by an earlier run, unless it is
+// older than -get-info-cache-max-age
+func readInfoCacheFile() (siteInfo, bool) {
+	var info siteInfo
+	if "" == getInfoCacheFile {
+		return info, false
+	}
+
+	stat, err := os.Stat(getInfoCacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Printf("error reading instance info cache %s: %s\n", getInfoCacheFile, err.Error())
+		}
+		return info, false
+	}
+	if age := time.Since(stat.ModTime()); getInfoCacheMaxAge > 0 && age > time.Duration(getInfoCacheMaxAge)*time.Second {
+		logger.Printf("WARNING: ignoring instance info cache %s, it is %s old", getInfoCacheFile, age.Round(time.Second))
+		return info, false
+	}
+
+	raw, err := ioutil.ReadFile(getInfoCacheFile)
+	if err == nil {
+		err = json.Unmarshal(raw, &info)
+	}
+	if err != nil {
+		logger.Printf("error reading instance info cache %s: %s\n", getInfoCacheFile, err.Error())
+		return info, false
+	}
+
+	return info, true
+}
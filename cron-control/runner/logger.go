@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -19,23 +20,35 @@ const (
 )
 
 type LogEntry struct {
-	Timestamp string `json:"ts"`
-	Message   string `json:"msg"`
+	Timestamp  string            `json:"ts"`
+	InstanceID string            `json:"instance,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Caller     string            `json:"caller,omitempty"`
+	Message    string            `json:"msg"`
 }
 
 type Logger struct {
-	FileName string
-	Type     LogType
-	l        *log.Logger
-	f        *os.File
-	logMutex *sync.Mutex
+	FileName   string
+	Type       LogType
+	InstanceID string
+	Labels     map[string]string
+	Flags      int
+	l          *log.Logger
+	f          *os.File
+	logMutex   *sync.Mutex
+
+	// Include the calling function's name in each entry
+	SourceLocation bool
+
+	// Rewrites each message before it is logged, e.g. to hide site URLs
+	Redact func(string) string
 }
 
 func (self *Logger) Init() {
 	self.logMutex = &sync.Mutex{}
 
 	if "os.Stdout" == self.FileName {
-		self.l = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
+		self.l = log.New(os.Stdout, self.prefix(), self.Flags)
 		return
 	}
 
@@ -53,46 +66,35 @@ func (self *Logger) Init() {
 }
 
 func (self *Logger) Println(v ...interface{}) {
-	self.logMutex.Lock()
-	var err error
+	self.output(fmt.Sprintln(v...), true)
+}
 
-	switch self.Type {
-	case Text:
-		err = self.l.Output(2, fmt.Sprintln(v...))
-	case JSON:
-		str := fmt.Sprintln(v...)
-		if 0 < len(str) && '\n' == str[len(str)-1] {
-			str = str[:len(str)-1]
-		}
-		var buf []byte
-		var jsonErr error
-		buf, jsonErr = json.Marshal(LogEntry{Message: str, Timestamp: time.Now().Format("2006/01/02 15:04:05.000")})
-		if nil == jsonErr {
-			_, err = self.f.WriteString(string(buf) + "\n")
-		}
-	}
+func (self *Logger) Printf(str string, v ...interface{}) {
+	self.output(fmt.Sprintf(str, v...), true)
+}
 
-	if nil != err {
-		fmt.Println(err.Error())
-		self.f.Close()
-		self.openLogFile()
-	}
-	self.logMutex.Unlock()
+// PrintfUnredacted logs without applying Redact, for output meant to let operators undo it
+func (self *Logger) PrintfUnredacted(str string, v ...interface{}) {
+	self.output(fmt.Sprintf(str, v...), false)
 }
 
-func (self *Logger) Printf(str string, v ...interface{}) {
+func (self *Logger) output(msg string, redact bool) {
+	if redact && nil != self.Redact {
+		msg = self.Redact(msg)
+	}
+
 	self.logMutex.Lock()
 	var err error
 	switch self.Type {
 	case Text:
-		err = self.l.Output(2, fmt.Sprintf(str, v...))
+		err = self.l.Output(3, self.callerPrefix()+msg)
 	case JSON:
-		if 0 < len(str) && '\n' == str[len(str)-1] {
-			str = str[:len(str)-1]
+		if 0 < len(msg) && '\n' == msg[len(msg)-1] {
+			msg = msg[:len(msg)-1]
 		}
 		var buf []byte
 		var jsonErr error
-		buf, jsonErr = json.Marshal(LogEntry{Message: fmt.Sprintf(str, v...), Timestamp: time.Now().Format("2006/01/02 15:04:05.000")})
+		buf, jsonErr = json.Marshal(LogEntry{Message: msg, InstanceID: self.InstanceID, Labels: self.Labels, Caller: self.caller(), Timestamp: self.timestamp()})
 		if nil == jsonErr {
 			_, err = self.f.WriteString(string(buf) + "\n")
 		}
@@ -134,7 +136,48 @@ func (self *Logger) openLogFile() error {
 	self.f = f
 
 	if Text == self.Type {
-		self.l = log.New(self.f, "", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
+		self.l = log.New(self.f, self.prefix(), self.Flags)
 	}
 	return nil
 }
+
+func (self *Logger) timestamp() string {
+	if 0 != self.Flags&log.Lmicroseconds {
+		return time.Now().Format("2006/01/02 15:04:05.000000")
+	}
+	return time.Now().Format("2006/01/02 15:04:05.000")
+}
+
+// caller returns the function that called Printf or Println, with SourceLocation
+func (self *Logger) caller() string {
+	if !self.SourceLocation {
+		return ""
+	}
+	// Skip caller, output and Printf/Println
+	return callerInfo(3)
+}
+
+func (self *Logger) callerPrefix() string {
+	if !self.SourceLocation {
+		return ""
+	}
+	return callerInfo(3) + ": "
+}
+
+// callerInfo returns the `package.Function` name `skip` frames above its caller
+func callerInfo(skip int) string {
+	pcs := make([]uintptr, 1)
+	if 0 == runtime.Callers(skip+2, pcs) {
+		return ""
+	}
+
+	frame, _ := runtime.CallersFrames(pcs).Next()
+	return frame.Function
+}
+
+func (self *Logger) prefix() string {
+	if "" == self.InstanceID {
+		return ""
+	}
+	return fmt.Sprintf("[%s] ", self.InstanceID)
+}
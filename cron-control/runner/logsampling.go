@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path"
+)
+
+var gActionLogSampling map[string]float64
+
+// parseActionLogSampling reads the -event-action-log-sampling JSON map of action
+// globs to the share of their event runs that are debug logged
+func parseActionLogSampling() {
+	gActionLogSampling = make(map[string]float64)
+	if "" == eventActionLogSampling {
+		return
+	}
+
+	if err := json.Unmarshal([]byte(eventActionLogSampling), &gActionLogSampling); err != nil {
+		fmt.Printf("Invalid action log sampling: %s\n", err.Error())
+		usage()
+	}
+
+	for glob, sampleRate := range gActionLogSampling {
+		if _, err := path.Match(glob, ""); err != nil {
+			fmt.Printf("Invalid action glob '%s': %s\n", glob, err.Error())
+			usage()
+		}
+		if sampleRate < 0 || sampleRate > 1 {
+			fmt.Printf("Invalid sampling rate %v for action glob '%s'\n", sampleRate, glob)
+			usage()
+		}
+	}
+}
+
+// sampleLogEvent reports whether to debug log a run of the action, using the
+// longest glob matching it; unmatched actions are always logged
+func sampleLogEvent(action string) bool {
+	sampleRate := 1.0
+	longest := -1
+	for glob, r := range gActionLogSampling {
+		if matched, _ := path.Match(glob, action); matched && len(glob) > longest {
+			sampleRate, longest = r, len(glob)
+		}
+	}
+
+	return rand.Float64() < sampleRate
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const rollingWindowSpan = time.Hour
+
+type rollingBucket struct {
+	Succeeded uint64
+	Errored   uint64
+}
+
+// RollingWindow keeps event run counts for the last hour, in buckets of -report-interval
+type RollingWindow struct {
+	buckets  []rollingBucket
+	interval time.Duration
+	current  int
+	mutex    sync.RWMutex
+}
+
+var gRollingWindow = NewRollingWindow(time.Minute)
+
+func NewRollingWindow(interval time.Duration) *RollingWindow {
+	if interval <= 0 || interval > rollingWindowSpan {
+		interval = time.Minute
+	}
+
+	count := int((rollingWindowSpan + interval - 1) / interval)
+	return &RollingWindow{buckets: make([]rollingBucket, count), interval: interval}
+}
+
+func (self *RollingWindow) Record(success bool) {
+	self.mutex.Lock()
+	if success {
+		self.buckets[self.current].Succeeded++
+	} else {
+		self.buckets[self.current].Errored++
+	}
+	self.mutex.Unlock()
+}
+
+// Rate returns the share of event runs that succeeded over the last `minutes`,
+// along with the totals it was derived from
+func (self *RollingWindow) Rate(minutes int) (float64, uint64, uint64) {
+	count := int((time.Duration(minutes)*time.Minute + self.interval - 1) / self.interval)
+	if count > len(self.buckets) {
+		count = len(self.buckets)
+	}
+
+	var succeeded, errored uint64
+	self.mutex.RLock()
+	for i := 0; i < count; i++ {
+		bucket := self.buckets[(self.current-i+len(self.buckets))%len(self.buckets)]
+		succeeded += bucket.Succeeded
+		errored += bucket.Errored
+	}
+	self.mutex.RUnlock()
+
+	if 0 == succeeded+errored {
+		return 0, 0, 0
+	}
+	return float64(succeeded) / float64(succeeded+errored), succeeded, errored
+}
+
+func (self *RollingWindow) advance() {
+	self.mutex.Lock()
+	self.current = (self.current + 1) % len(self.buckets)
+	self.buckets[self.current] = rollingBucket{}
+	self.mutex.Unlock()
+}
+
+// Run rotates to a fresh bucket every interval until the context is cancelled
+func (self *RollingWindow) Run(ctx context.Context) {
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			self.advance()
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package main
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// niceArgs returns a `nice` prefix that moves an event run to -event-run-niceness. It goes
+// inside the sudo and ulimit wrappers, so the niceness is set before PHP starts
+func niceArgs() []string {
+	if 0 == eventRunNiceness {
+		return nil
+	}
+
+	// nice takes an adjustment, and the raw getpriority syscall returns 20 - nice
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		logger.Printf("error reading the runner's niceness: %s\n", err.Error())
+		return nil
+	}
+	adjustment := eventRunNiceness - (20 - prio)
+	if 0 == adjustment {
+		return nil
+	}
+
+	return []string{"nice", "-n", strconv.Itoa(adjustment)}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// niceArgs is a no-op, niceness is only supported on Linux
+func niceArgs() []string {
+	return nil
+}
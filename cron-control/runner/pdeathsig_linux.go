@@ -0,0 +1,51 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+var gPdeathsig syscall.Signal
+
+var pdeathsigNames = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// parsePdeathsig validates -event-run-pdeathsig, where an empty name disables it
+func parsePdeathsig() {
+	if "" == eventRunPdeathsig {
+		return
+	}
+
+	sig, found := pdeathsigNames[eventRunPdeathsig]
+	if !found {
+		fmt.Printf("Invalid parent death signal '%s'\n", eventRunPdeathsig)
+		usage()
+	}
+	gPdeathsig = sig
+}
+
+// setPdeathsig has the kernel signal an event run's process if the runner dies without
+// cleaning up. The kernel clears the signal when a set-user-ID binary is executed, so
+// it doesn't reach WP-CLI run through sudo. It is also tied to the OS thread that
+// started the process rather than the runner, which is safe because the runner never
+// locks goroutines to threads and the Go runtime only retires threads that were locked
+func setPdeathsig(cmd *exec.Cmd) {
+	if 0 == gPdeathsig {
+		return
+	}
+
+	if nil == cmd.SysProcAttr {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Pdeathsig = gPdeathsig
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// parsePdeathsig is a no-op, parent death signals are only supported on Linux
+func parsePdeathsig() {}
+
+// setPdeathsig is a no-op, parent death signals are only supported on Linux
+func setPdeathsig(cmd *exec.Cmd) {}
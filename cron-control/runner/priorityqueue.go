@@ -0,0 +1,111 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type queuedEvent struct {
+	event    event
+	priority int64
+}
+
+// eventHeap orders events by priority, highest first
+type eventHeap []queuedEvent
+
+func (self eventHeap) Len() int            { return len(self) }
+func (self eventHeap) Less(i, j int) bool  { return self[i].priority > self[j].priority }
+func (self eventHeap) Swap(i, j int)       { self[i], self[j] = self[j], self[i] }
+func (self *eventHeap) Push(x interface{}) { *self = append(*self, x.(queuedEvent)) }
+func (self *eventHeap) Pop() interface{} {
+	old := *self
+	item := old[len(old)-1]
+	*self = old[:len(old)-1]
+	return item
+}
+
+// EventQueue hands out the most overdue events first, holding up to `max` events
+type EventQueue struct {
+	items  eventHeap
+	max    int
+	closed bool
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func NewEventQueue(max int) *EventQueue {
+	queue := &EventQueue{max: max}
+	queue.cond = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+// Push adds an event with priority `max(0, now - timestamp)`, blocking while the queue is full
+func (self *EventQueue) Push(e event) {
+	priority := time.Now().Unix() - int64(e.Timestamp)
+	if priority < 0 {
+		priority = 0
+	}
+
+	self.mutex.Lock()
+	for self.max > 0 && len(self.items) >= self.max && !self.closed {
+		self.cond.Wait()
+	}
+	heap.Push(&self.items, queuedEvent{event: e, priority: priority})
+	atomic.AddInt64(&gQueuedEvents, 1)
+	self.cond.Broadcast()
+	self.mutex.Unlock()
+}
+
+// Pop removes the highest priority event, blocking while the queue is empty; it
+// returns false once the queue is closed and drained
+func (self *EventQueue) Pop() (event, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for 0 == len(self.items) && !self.closed {
+		self.cond.Wait()
+	}
+	if 0 == len(self.items) {
+		return event{}, false
+	}
+
+	item := heap.Pop(&self.items).(queuedEvent)
+	atomic.AddInt64(&gQueuedEvents, -1)
+	self.cond.Broadcast()
+	return item.event, true
+}
+
+func (self *EventQueue) Close() {
+	self.mutex.Lock()
+	self.closed = true
+	self.cond.Broadcast()
+	self.mutex.Unlock()
+}
+
+// prioritizeEvents reorders events from `queue` by how overdue they are, using -queue-buffer
+// as the most events held at once
+func prioritizeEvents(queue <-chan event) <-chan event {
+	pq := NewEventQueue(queueBuffer)
+	go func() {
+		for e := range queue {
+			pq.Push(e)
+		}
+		pq.Close()
+	}()
+
+	prioritized := make(chan event)
+	go func() {
+		for {
+			e, ok := pq.Pop()
+			if !ok {
+				break
+			}
+			prioritized <- e
+		}
+		close(prioritized)
+	}()
+
+	return prioritized
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventQueueOrder(t *testing.T) {
+	now := int(time.Now().Unix())
+	queue := NewEventQueue(0)
+	for _, timestamp := range []int{now - 10, now + 60, now - 100, now - 50} {
+		queue.Push(event{Timestamp: timestamp})
+	}
+
+	for _, expected := range []int{now - 100, now - 50, now - 10, now + 60} {
+		e, ok := queue.Pop()
+		if !ok {
+			t.Fatal("Pop returned false before the queue was drained")
+		}
+		if e.Timestamp != expected {
+			t.Errorf("popped timestamp %d, expected %d", e.Timestamp, expected)
+		}
+	}
+}
+
+func TestEventQueueClose(t *testing.T) {
+	queue := NewEventQueue(0)
+	queue.Push(event{Action: "queued"})
+	queue.Close()
+
+	if e, ok := queue.Pop(); !ok || "queued" != e.Action {
+		t.Errorf("Pop after Close returned %v, %v, expected the queued event", e, ok)
+	}
+	if _, ok := queue.Pop(); ok {
+		t.Error("Pop on a closed, drained queue returned true")
+	}
+}
+
+func TestEventQueueFull(t *testing.T) {
+	queue := NewEventQueue(1)
+	queue.Push(event{Action: "first"})
+
+	pushed := make(chan struct{})
+	go func() {
+		queue.Push(event{Action: "second"})
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("Push returned while the queue was full")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	queue.Pop()
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("Push stayed blocked after Pop made room")
+	}
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+// setProcGroup starts an event run in its own process group for -event-run-procgroup
+func setProcGroup(cmd *exec.Cmd) {
+	if !eventRunProcGroup {
+		return
+	}
+
+	if nil == cmd.SysProcAttr {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcGroupOnTimeout kills the whole process group of `pid` if `ctx` times out,
+// taking any children WP-CLI spawned with it; call the returned func once the process exits
+func killProcGroupOnTimeout(ctx context.Context, pid int) func() {
+	if !eventRunProcGroup {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			if context.DeadlineExceeded == ctx.Err() {
+				if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil && syscall.ESRCH != err {
+					logger.Printf("error killing process group %d: %s\n", pid, err.Error())
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// setProcGroup is a no-op, process groups are only used on Linux
+func setProcGroup(cmd *exec.Cmd) {}
+
+// killProcGroupOnTimeout is a no-op, process groups are only used on Linux
+func killProcGroupOnTimeout(ctx context.Context, pid int) func() {
+	return func() {}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ActionLimiter is a token bucket holding one token, refilled every interval. Limiters
+// live for the whole process, so the refill goroutine and its ticker are never stopped
+type ActionLimiter struct {
+	tokens chan struct{}
+}
+
+func NewActionLimiter(interval time.Duration) *ActionLimiter {
+	limiter := &ActionLimiter{tokens: make(chan struct{}, 1)}
+	limiter.tokens <- struct{}{}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			select {
+			case limiter.tokens <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return limiter
+}
+
+// Wait blocks until a token is available or the context is done
+func (self *ActionLimiter) Wait(ctx context.Context) error {
+	select {
+	case <-self.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var gActionLimiters map[string]*ActionLimiter
+
+var gConcurrencyKey *template.Template
+
+// parseActionRateLimits turns the -event-action-rate-limit JSON map of action
+// globs to events per minute into limiters shared by all workers
+func parseActionRateLimits() {
+	gActionLimiters = make(map[string]*ActionLimiter)
+	if "" == eventActionRateLimit {
+		return
+	}
+
+	intervals, err := actionRateLimitIntervals(eventActionRateLimit)
+	if err != nil {
+		fmt.Printf("Invalid action rate limits: %s\n", err.Error())
+		usage()
+	}
+
+	for glob, interval := range intervals {
+		gActionLimiters[glob] = NewActionLimiter(interval)
+	}
+}
+
+// actionRateLimitIntervals parses a JSON map of action globs to events per minute
+// into the interval between events for each glob
+func actionRateLimitIntervals(raw string) (map[string]time.Duration, error) {
+	limits := make(map[string]float64)
+	if err := json.Unmarshal([]byte(raw), &limits); err != nil {
+		return nil, err
+	}
+
+	intervals := make(map[string]time.Duration, len(limits))
+	for glob, perMinute := range limits {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("action glob '%s': %s", glob, err.Error())
+		}
+		if perMinute <= 0 {
+			return nil, fmt.Errorf("rate %v for action glob '%s' must be positive", perMinute, glob)
+		}
+
+		// Rates too high to express as a whole number of nanoseconds would truncate to a
+		// zero interval, which time.NewTicker rejects
+		interval := time.Duration(float64(time.Minute) / perMinute)
+		if interval < 1 {
+			return nil, fmt.Errorf("rate %v for action glob '%s' is too high", perMinute, glob)
+		}
+		intervals[glob] = interval
+	}
+
+	return intervals, nil
+}
+
+// parseConcurrencyKey compiles -event-concurrency-key, checking it against a sample event
+func parseConcurrencyKey() {
+	if "" == eventConcurrencyKey {
+		return
+	}
+
+	var err error
+	if gConcurrencyKey, err = template.New("concurrency-key").Option("missingkey=error").Parse(eventConcurrencyKey); err != nil {
+		fmt.Printf("Invalid event concurrency key: %s\n", err.Error())
+		usage()
+	}
+
+	sample := event{URL: "https://example.com", Timestamp: 1, Action: "action", Instance: strings.Repeat("0", 32)}
+	if err = gConcurrencyKey.Execute(&bytes.Buffer{}, sample); err != nil {
+		fmt.Printf("Invalid event concurrency key: %s\n", err.Error())
+		usage()
+	}
+}
+
+// concurrencyKey is what -event-action-rate-limit globs are matched against, the
+// event's action unless -event-concurrency-key is set
+func concurrencyKey(e event) string {
+	if nil == gConcurrencyKey {
+		return e.Action
+	}
+
+	var key bytes.Buffer
+	if err := gConcurrencyKey.Execute(&key, e); err != nil {
+		logger.Printf("WARNING: error evaluating concurrency key for job %d|%s|%s for %s, using its action: %s", e.Timestamp, e.Action, e.Instance, e.URL, err.Error())
+		return e.Action
+	}
+
+	return key.String()
+}
+
+// actionLimiter returns the limiter for the longest glob matching the action, if any
+func actionLimiter(action string) *ActionLimiter {
+	var limiter *ActionLimiter
+	longest := -1
+	for glob, l := range gActionLimiters {
+		if matched, _ := path.Match(glob, action); matched && len(glob) > longest {
+			limiter, longest = l, len(glob)
+		}
+	}
+
+	return limiter
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestActionRateLimitIntervals(t *testing.T) {
+	tests := []struct {
+		raw      string
+		glob     string
+		interval time.Duration
+		valid    bool
+	}{
+		{`{"wp_*": 60}`, "wp_*", time.Second, true},
+		{`{"wp_*": 0.5}`, "wp_*", 2 * time.Minute, true},
+		{`{"wp_*": 0}`, "", 0, false},
+		{`{"wp_*": -1}`, "", 0, false},
+		{`{"wp_*": 1e11}`, "", 0, false},
+		{`{"[": 1}`, "", 0, false},
+		{`{"wp_*": "fast"}`, "", 0, false},
+	}
+
+	for _, test := range tests {
+		intervals, err := actionRateLimitIntervals(test.raw)
+		if !test.valid {
+			if nil == err {
+				t.Errorf("%s: expected an error", test.raw)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.raw, err.Error())
+		} else if intervals[test.glob] != test.interval {
+			t.Errorf("%s: interval %s, expected %s", test.raw, intervals[test.glob], test.interval)
+		}
+	}
+}
+
+func TestActionLimiterLongestMatch(t *testing.T) {
+	defer func(saved map[string]*ActionLimiter) { gActionLimiters = saved }(gActionLimiters)
+
+	any, wp, exact := &ActionLimiter{}, &ActionLimiter{}, &ActionLimiter{}
+	gActionLimiters = map[string]*ActionLimiter{"*": any, "wp_*": wp, "wp_update_plugins": exact}
+
+	tests := []struct {
+		action  string
+		limiter *ActionLimiter
+	}{
+		{"wp_update_plugins", exact},
+		{"wp_version_check", wp},
+		{"custom_action", any},
+	}
+
+	for _, test := range tests {
+		if limiter := actionLimiter(test.action); limiter != test.limiter {
+			t.Errorf("%s: got the wrong limiter", test.action)
+		}
+	}
+}
+
+func TestActionLimiterWait(t *testing.T) {
+	limiter := NewActionLimiter(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.Wait(ctx); err != nil {
+		t.Fatalf("first Wait: %s", err.Error())
+	}
+	if err := limiter.Wait(ctx); nil == err {
+		t.Error("second Wait returned before the refill interval")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Site URLs and their site-NNNN tokens for -log-redact-site-urls
+var (
+	gSiteTokens       = make(map[string]string)
+	gSiteTokensLogged bool
+	gSiteURLReplacer  *strings.Replacer
+	gSiteTokenMutex   sync.RWMutex
+)
+
+// registerSiteURLs assigns each URL not seen before the next site-NNNN token. Once
+// the first site list's tokens have been logged, new tokens are logged with -debug
+// as they are assigned
+func registerSiteURLs(urls ...string) {
+	if !logRedactSiteURLs {
+		return
+	}
+
+	var added []string
+	gSiteTokenMutex.Lock()
+	for _, u := range urls {
+		if _, found := gSiteTokens[u]; found || "" == u {
+			continue
+		}
+		gSiteTokens[u] = fmt.Sprintf("site-%04d", len(gSiteTokens)+1)
+		added = append(added, fmt.Sprintf("%s is %s", gSiteTokens[u], u))
+	}
+	if 0 < len(added) {
+		known := make([]string, 0, len(gSiteTokens))
+		for u := range gSiteTokens {
+			known = append(known, u)
+		}
+		// The replacer tries URLs in order, so put the longest first
+		sort.Slice(known, func(i, j int) bool { return len(known[i]) > len(known[j]) })
+
+		pairs := make([]string, 0, 2*len(known))
+		for _, u := range known {
+			pairs = append(pairs, u, gSiteTokens[u])
+		}
+		gSiteURLReplacer = strings.NewReplacer(pairs...)
+	}
+	logged := gSiteTokensLogged
+	gSiteTokenMutex.Unlock()
+
+	if debug && logged {
+		for _, mapping := range added {
+			logger.PrintfUnredacted("site URL token %s", mapping)
+		}
+	}
+}
+
+// logSiteTokens logs every token assigned so far with -debug, once, after the
+// first site list has been registered
+func logSiteTokens() {
+	gSiteTokenMutex.Lock()
+	if gSiteTokensLogged {
+		gSiteTokenMutex.Unlock()
+		return
+	}
+	gSiteTokensLogged = true
+
+	mappings := make([]string, 0, len(gSiteTokens))
+	for u, token := range gSiteTokens {
+		mappings = append(mappings, fmt.Sprintf("%s is %s", token, u))
+	}
+	gSiteTokenMutex.Unlock()
+
+	if !debug || !logRedactSiteURLs {
+		return
+	}
+	sort.Strings(mappings)
+	for _, mapping := range mappings {
+		logger.PrintfUnredacted("site URL token %s", mapping)
+	}
+}
+
+// redactSiteURLs replaces every registered site URL in the message with its token
+func redactSiteURLs(msg string) string {
+	gSiteTokenMutex.RLock()
+	replacer := gSiteURLReplacer
+	gSiteTokenMutex.RUnlock()
+
+	if nil == replacer {
+		return msg
+	}
+	return replacer.Replace(msg)
+}
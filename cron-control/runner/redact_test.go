@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func resetSiteTokens() {
+	gSiteTokenMutex.Lock()
+	gSiteTokens, gSiteTokensLogged, gSiteURLReplacer = make(map[string]string), false, nil
+	gSiteTokenMutex.Unlock()
+}
+
+func TestRedactSiteURLs(t *testing.T) {
+	defer func(saved bool) { logRedactSiteURLs = saved; resetSiteTokens() }(logRedactSiteURLs)
+
+	logRedactSiteURLs = true
+	resetSiteTokens()
+	registerSiteURLs("https://example.com", "https://example.com.au", "", "https://example.com")
+
+	tests := []struct {
+		msg      string
+		redacted string
+	}{
+		{"retrieved 3 events for https://example.com", "retrieved 3 events for site-0001"},
+		{"retrieved 3 events for https://example.com.au/blog", "retrieved 3 events for site-0002/blog"},
+		{"https://example.com and https://example.com.au", "site-0001 and site-0002"},
+		{"retrieved 3 events for https://example.org", "retrieved 3 events for https://example.org"},
+	}
+
+	for _, test := range tests {
+		if redacted := redactSiteURLs(test.msg); redacted != test.redacted {
+			t.Errorf("redactSiteURLs(%q) = %q, expected %q", test.msg, redacted, test.redacted)
+		}
+	}
+}
+
+func TestRedactSiteURLsDisabled(t *testing.T) {
+	defer func(saved bool) { logRedactSiteURLs = saved; resetSiteTokens() }(logRedactSiteURLs)
+
+	logRedactSiteURLs = false
+	resetSiteTokens()
+	registerSiteURLs("https://example.com")
+
+	if msg := redactSiteURLs("https://example.com"); !strings.Contains(msg, "example.com") {
+		t.Errorf("redacted %q with -log-redact-site-urls disabled", msg)
+	}
+}
@@ -806,7 +806,7 @@ func runWpCliCmdRemote(conn *net.TCPConn, Guid string, rows uint16, cols uint16,
 	}
 
 	usage := state.SysUsage().(*syscall.Rusage)
-	logger.Printf("Guid %s : max rss: %0.0f KB : user time %0.2f sec : sys time %0.2f sec",
+	logger.Printf("Guid %s : peak rss: %0.0f KB : user time %0.2f sec : sys time %0.2f sec",
 		Guid,
 		float64(usage.Maxrss)/1024,
 		float64(usage.Utime.Sec)+float64(usage.Utime.Usec)/1e6,
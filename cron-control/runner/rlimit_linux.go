@@ -0,0 +1,31 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// resourceLimitArgs wraps an event run in a shell that sets the -event-run-ulimit-* limits
+// before exec'ing it, so they apply from the start and to the process sudo runs, not sudo
+func resourceLimitArgs(args []string) []string {
+	var limits []string
+	if eventRunUlimitAS > 0 {
+		// ulimit takes KiB
+		kib := eventRunUlimitAS / 1024
+		if kib < 1 {
+			kib = 1
+		}
+		limits = append(limits, fmt.Sprintf("ulimit -v %d", kib))
+	}
+	if eventRunUlimitCPU > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -t %d", eventRunUlimitCPU))
+	}
+	if 0 == len(limits) {
+		return args
+	}
+
+	script := strings.Join(limits, " && ") + ` && exec "$@"`
+	return append([]string{"/bin/sh", "-c", script, "sh"}, args...)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// resourceLimitArgs is a no-op, resource limits are only supported on Linux
+func resourceLimitArgs(args []string) []string {
+	return args
+}
@@ -0,0 +1,97 @@
+<?php
+/**
+ * Execute a single event without WP-CLI
+ *
+ * Not intended for human use, rather it powers the Go-based Runner's `-run-event-with-php` option.
+ * Accepts the same `--timestamp`, `--action`, `--instance`, `--stdin`, `--url`, and `--path` arguments as
+ * `wp cron-control orchestrate runner-only run`; other WP-CLI arguments are ignored.
+ *
+ * @package a8c_Cron_Control
+ */
+
+if ( 'cli' !== PHP_SAPI ) {
+	exit( 1 );
+}
+
+$assoc_args = array();
+foreach ( array_slice( $argv, 1 ) as $arg ) {
+	if ( preg_match( '#^--([^=]+)=(.*)$#s', $arg, $matches ) ) {
+		$assoc_args[ $matches[1] ] = $matches[2];
+	} elseif ( '--stdin' === $arg ) {
+		$payload = json_decode( file_get_contents( 'php://stdin' ), true ); // phpcs:ignore WordPress.WP.AlternativeFunctions.file_get_contents_file_get_contents
+		if ( ! is_array( $payload ) ) {
+			echo "Error: Invalid event on stdin\n";
+			exit( 1 );
+		}
+
+		foreach ( array( 'timestamp', 'action', 'instance' ) as $key ) {
+			if ( isset( $payload[ $key ] ) ) {
+				$assoc_args[ $key ] = (string) $payload[ $key ];
+			}
+		}
+	}
+}
+
+foreach ( array( 'timestamp', 'action', 'instance', 'url', 'path' ) as $required ) {
+	if ( ! isset( $assoc_args[ $required ] ) || '' === $assoc_args[ $required ] ) {
+		echo "Error: Missing --{$required}\n";
+		exit( 1 );
+	}
+}
+
+// Let WordPress select the site the same way it would for a request to its URL.
+$url = parse_url( $assoc_args['url'] ); // phpcs:ignore WordPress.WP.AlternativeFunctions.parse_url_parse_url -- WordPress isn't loaded yet.
+if ( empty( $url['host'] ) ) {
+	echo "Error: Invalid --url\n";
+	exit( 1 );
+}
+
+$_SERVER['HTTP_HOST']      = isset( $url['port'] ) ? $url['host'] . ':' . $url['port'] : $url['host'];
+$_SERVER['SERVER_NAME']    = $url['host'];
+$_SERVER['REQUEST_URI']    = isset( $url['path'] ) ? $url['path'] : '/';
+$_SERVER['REQUEST_METHOD'] = 'GET';
+if ( isset( $url['scheme'] ) && 'https' === $url['scheme'] ) {
+	$_SERVER['HTTPS'] = 'on';
+}
+
+define( 'WP_USE_THEMES', false );
+require rtrim( $assoc_args['path'], '/' ) . '/wp-load.php';
+
+if ( ! function_exists( '\Automattic\WP\Cron_Control\run_event' ) ) {
+	echo "Error: Cron Control is not active\n";
+	exit( 1 );
+}
+
+if ( 0 !== \Automattic\WP\Cron_Control\Events::instance()->run_disabled() ) {
+	echo "Error: Automatic event execution is disabled\n";
+	exit( 1 );
+}
+
+if ( ! is_numeric( $assoc_args['timestamp'] ) || $assoc_args['timestamp'] > time() ) {
+	echo "Error: Invalid timestamp\n";
+	exit( 1 );
+}
+
+// Prepare environment.
+\Automattic\WP\Cron_Control\set_doing_cron();
+
+// Run the event.
+$run = \Automattic\WP\Cron_Control\run_event( $assoc_args['timestamp'], $assoc_args['action'], $assoc_args['instance'] );
+
+if ( is_wp_error( $run ) ) {
+	$error_data = $run->get_error_data();
+
+	if ( isset( $error_data['status'] ) && 404 === $error_data['status'] ) {
+		echo 'Warning: ' . $run->get_error_message() . "\n"; // phpcs:ignore WordPress.Security.EscapeOutput.OutputNotEscaped
+
+		exit;
+	}
+
+	echo 'Error: ' . $run->get_error_message() . "\n"; // phpcs:ignore WordPress.Security.EscapeOutput.OutputNotEscaped
+	exit( 1 );
+} elseif ( isset( $run['success'] ) && true === $run['success'] ) {
+	echo 'Success: ' . $run['message'] . "\n"; // phpcs:ignore WordPress.Security.EscapeOutput.OutputNotEscaped
+} else {
+	echo 'Error: ' . $run['message'] . "\n"; // phpcs:ignore WordPress.Security.EscapeOutput.OutputNotEscaped
+	exit( 1 );
+}
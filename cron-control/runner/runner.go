@@ -1,15 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
 	"math/rand"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -19,10 +32,45 @@ type siteInfo struct {
 	Multisite int
 	Siteurl   string
 	Disabled  int
+	Version   string
 }
 
 type site struct {
 	URL string
+
+	// Additional `wp site list` fields requested with -multisite-extra-fields
+	ExtraFields map[string]string `json:"-"`
+
+	// Network ID extracted with -multisite-network-id-from-url, `0` to use -network
+	NetworkID int `json:"-"`
+}
+
+func (self *site) UnmarshalJSON(data []byte) error {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	for name, value := range fields {
+		if strings.EqualFold("url", name) {
+			if err := json.Unmarshal(value, &self.URL); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if nil == self.ExtraFields {
+			self.ExtraFields = make(map[string]string)
+		}
+		var str string
+		if err := json.Unmarshal(value, &str); err == nil {
+			self.ExtraFields[name] = str
+		} else {
+			self.ExtraFields[name] = string(value)
+		}
+	}
+
+	return nil
 }
 
 type event struct {
@@ -30,139 +78,823 @@ type event struct {
 	Timestamp int
 	Action    string
 	Instance  string
+
+	// Number of times this event has been retried after failing
+	Attempts int `json:"-"`
+
+	// Network ID of the site the event belongs to, `0` to use -network
+	NetworkID int `json:"-"`
 }
 
 var (
 	wpCliPath string
+	wpCliPHP  string
 	wpNetwork int
 	wpPath    string
-
-	numGetWorkers int
-	numRunWorkers int
+	wpRunUser string
+	wpNoColor bool
+	wpColor   string
+
+	wpCliPathFallback string
+
+	wpCliSkipPlugins string
+	wpCliSkipThemes  bool
+	wpCliCacheDir    string
+
+	runEventWithPHP   bool
+	runEventPHPScript string
+	runEventStdin     bool
+
+	wpCliDebug       bool
+	wpCliDebugLog    string
+	wpCliDebugLogger *Logger
+
+	eventRunUlimitAS  int64
+	eventRunUlimitCPU int64
+	eventRunNiceness  int
+	eventRunPdeathsig string
+	eventRunProcGroup bool
+	eventRunCwd       string
+	eventRunEnvFile   string
+
+	wpCliPathFile string
+	wpNetworkFile string
+	wpPathFile    string
+
+	numGetWorkers    int
+	numGetWorkersMax int
+	numGetConcurrent int
+	sitesBuffer      int
+	sitesOverflow    string
+	sitesPerWorker   int
+	numRunWorkers    int
+	numRunWorkersMin int
+	numRunWorkersMax int
+	scaleInterval    int
+	workerAffinity   bool
+	maxWorkerIdle    int
+	workerStartDelay int
+
+	runWorkersPerCPU float64
+
+	eventQueuePriority bool
+	queueBuffer        int
+
+	sitesRefreshOnError    bool
+	sitesRefreshErrorDelay int
+	sitesRefreshMaxRetries int
 
 	getEventsInterval int
-
-	heartbeatInt int64
+	getInfoInterval   int
+	getInfoEveryTick  bool
+	startupDelay      int
+	eventTimeout      int
+	maxEventQueueWait int
+	eventBatchSize    int
+	eventOrder        string
+	eventTsTolerance  int
+
+	getInfoCacheFile   string
+	getInfoCacheMaxAge int
+
+	eventActionTimeouts string
+	getEventsStrict     bool
+
+	getEventsUserAgent string
+
+	maxRunWorkersPerSite int
+	gSiteWorkerCounts    = make(map[string]int)
+	gSiteWorkerMutex     = &sync.Mutex{}
+
+	eventRetryCount       int
+	eventRetryDelay       int
+	deadLetterLog         string
+	getEventsFailureLog   string
+	eventLog              string
+	eventLogFormat        string
+	eventInstanceValidate bool
+	eventURLValidate      bool
+	eventActionSanitize   bool
+	eventActionRateLimit  string
+
+	eventActionLogSampling string
+	eventConcurrencyKey    string
+
+	eventDedupInFlightTTL   int
+	eventDedupSweepInterval int
+
+	heartbeatInt                int64
+	reportInterval              int
+	heartbeatIncludeWorkerStats bool
+	heartbeatActionStats        int
+	disableHeartbeatReset       bool
+	statusFile                  string
+	heartbeatFile               string
+	eventsChannelTelemetry      bool
+
+	heartbeatSlackWebhook     string
+	heartbeatSlackOnErrorOnly bool
+	heartbeatSlackTimeout     int
 
 	disabledLoopCount    uint64
+	disabledState        int32
+	disabledCheckInt     int
 	eventRunErrCount     uint64
 	eventRunSuccessCount uint64
-
-	logger    *Logger
-	logDest   string
-	logFormat string
-	debug     bool
-
-	smartSiteList bool
-
-	gRestart                bool
+	eventDroppedCount    uint64
+	eventInvalidCount    uint64
+	workerSuccessCounts  []uint64
+
+	wpCliRetryExitCodes string
+	wpCliRetryCount     int
+	wpCliRetryDelay     int
+	gRetryExitCodes     map[int]bool
+
+	maxConsecutiveErrors  int
+	consecutiveErrorCount int32
+
+	maxMemoryMB        int
+	memoryPollInterval int
+
+	selfTestInterval         int
+	selfTestFailures         int
+	selfTestRestartOnFailure bool
+
+	logger     *Logger
+	logDest    string
+	logFormat  string
+	debug      bool
+	trace      bool
+	logEvents  bool
+	logCliArgs bool
+	logEvtArgs bool
+	logRedact  string
+	instanceID string
+
+	logRedactSiteURLs bool
+
+	cloudMetadataURL string
+	instanceLabel    string
+
+	logCaller       bool
+	logSourceLoc    bool
+	logMicroseconds bool
+	logUTC          bool
+
+	drainOnSigterm bool
+
+	smartSiteList   bool
+	siteURLStripWww bool
+	siteURLScheme   string
+	siteURLOverride bool
+
+	siteSchemeRejectedCount uint64
+
+	multisiteExtraFields  string
+	multisiteNetworkIDURL string
+	multisiteIncludeIDs   string
+	multisiteExcludeIDs   string
+	multisiteSort         string
+	multisiteNetworkIDs   string
+	multisiteBlogLimit    int
+	multisiteDomains      string
+	gMultisiteDomainRegex *regexp.Regexp
+	gIncludeBlogIDs       map[int]struct{}
+	gExcludeBlogIDs       map[int]struct{}
+	gNetworkIDRegex       *regexp.Regexp
+	siteListSource        string
+	siteListSourceTimeout int
+
+	multisiteAPIURL      string
+	multisiteAPIToken    string
+	multisiteAPIFallback bool
+	siteCacheTTL         int
+
+	checkpointFile     string
+	checkpointInterval int
+
+	gCancel                 context.CancelFunc
+	gDrain                  context.CancelFunc
+	gBusyRetrievers         int32
+	gActiveWorkers          int32
+	gPendingEvents          int64
+	gQueuedEvents           int64
+	gRetryEvents            chan event
+	gAffinityEvents         []chan event
+	gInfoCache              siteInfo
+	gInfoCacheTime          time.Time
+	gInfoCacheMutex         = &sync.Mutex{}
+	gReenabled              = make(chan struct{}, 1)
+	gSiteCounts             chan int
+	gExitCode               int32
 	gEventRetrieversRunning []bool
 	gEventWorkersRunning    []bool
 	gSiteRetrieverRunning   bool
 	gRandomDeltaMap         map[string]int64
 	gRemoteToken            string
 	gGuidLength             int
+
+	configDump bool
+	runOnce    bool
+	jsonEvents bool
 )
 
 const getEventsBreakSec time.Duration = 1 * time.Second
 const runEventsBreakSec int64 = 10
+const maxEventAge time.Duration = 365 * 24 * time.Hour
+
+var ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+var eventInstanceRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+var instanceLabelKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
 
 func init() {
 	flag.StringVar(&wpCliPath, "cli", "/usr/local/bin/wp", "Path to WP-CLI binary")
+	flag.StringVar(&wpCliPathFallback, "wpcli-path-fallback", "", "Colon-separated WP-CLI binary paths to try in order when -cli does not exist")
+	flag.StringVar(&wpCliPHP, "wp-cli-php", "", "Path to the PHP binary used to run WP-CLI, omit to use WP-CLI's own")
 	flag.IntVar(&wpNetwork, "network", 0, "WordPress network ID, `0` to disable")
 	flag.StringVar(&wpPath, "wp", "/var/www/html", "Path to WordPress installation")
+	flag.StringVar(&wpCliPathFile, "cli-file", "", "File containing the path to the WP-CLI binary, instead of -cli")
+	flag.StringVar(&wpNetworkFile, "network-id-file", "", "File containing the WordPress network ID, instead of -network")
+	flag.StringVar(&wpPathFile, "wp-file", "", "File containing the path to the WordPress installation, instead of -wp")
+	flag.BoolVar(&wpNoColor, "no-color", true, "Pass `--no-color` to WP-CLI to keep ANSI colour codes out of its output")
+	flag.StringVar(&wpColor, "wp-cli-color", "", "WP-CLI colour output, 'always', 'never' or 'auto' to let WP-CLI decide, overriding -no-color; omit to follow -no-color")
+	flag.StringVar(&wpCliSkipPlugins, "wp-cli-skip-plugins", "", "Comma-separated plugin slugs WP-CLI should not load, `*` for all")
+	flag.BoolVar(&wpCliSkipThemes, "wp-cli-skip-themes", false, "Do not load themes when running WP-CLI")
+	flag.BoolVar(&wpCliDebug, "wpcli-debug", false, "Pass `--debug` to WP-CLI and capture its debug output")
+	flag.StringVar(&wpCliDebugLog, "wpcli-debug-log", "", "Path to log WP-CLI debug output to, omit to log it only when a command fails")
+	flag.Int64Var(&eventRunUlimitAS, "event-run-ulimit-as", 0, "Address space limit in bytes for WP-CLI processes running events, rounded down to KiB, `0` for unlimited (Linux only)")
+	flag.Int64Var(&eventRunUlimitCPU, "event-run-ulimit-cpu", 0, "CPU time limit in seconds for WP-CLI processes running events, `0` for unlimited (Linux only)")
+	flag.StringVar(&eventRunPdeathsig, "event-run-pdeathsig", "SIGTERM", "Signal sent to event run processes if the runner dies, e.g. when killed with SIGKILL; empty to disable (Linux only). Has no effect with -event-run-user, as the kernel clears it when sudo execs")
+	flag.BoolVar(&eventRunProcGroup, "event-run-procgroup", false, "Run each event's WP-CLI process in its own process group, killing the whole group on -event-timeout (Linux only)")
+	flag.IntVar(&eventRunNiceness, "event-run-niceness", 0, "Niceness from -20 to 19 for WP-CLI processes running events, `0` to leave unchanged (Linux only). With -event-run-user, negative values need that user to be allowed to raise priority")
+	flag.StringVar(&wpRunUser, "event-run-user", "", "OS user to run WP-CLI as via `sudo`, omit to run as the current user")
+	flag.StringVar(&wpCliRetryExitCodes, "wpcli-retry-exit-codes", "", "Comma-separated WP-CLI exit codes that are retried, e.g. `255,127`")
+	flag.IntVar(&wpCliRetryCount, "wpcli-retry-count", 0, "Times to retry a WP-CLI command exiting with a retryable code, `0` to disable")
+	flag.IntVar(&wpCliRetryDelay, "wpcli-retry-delay", 500, "Milliseconds to wait between WP-CLI retries")
 	flag.IntVar(&numGetWorkers, "workers-get", 1, "Number of workers to retrieve events")
+	flag.IntVar(&sitesPerWorker, "sites-per-worker", 0, "Sites per event-retrieval worker, spawning more workers as the site list grows, `0` to use -workers-get")
+	flag.IntVar(&numGetWorkersMax, "workers-get-max", 10, "Maximum number of workers to retrieve events when using -sites-per-worker")
+	flag.BoolVar(&sitesRefreshOnError, "sites-refresh-on-error", false, "Retry retrieving the site list straight away after an error, instead of waiting for the next interval")
+	flag.IntVar(&sitesRefreshErrorDelay, "sites-refresh-error-delay", 5000, "Milliseconds to wait before each -sites-refresh-on-error retry")
+	flag.IntVar(&sitesRefreshMaxRetries, "sites-refresh-max-retries", 3, "Retries of the site list with -sites-refresh-on-error before waiting for the next interval")
+	flag.IntVar(&sitesBuffer, "sites-buffer", 0, "Number of sites queued for event-retrieval workers before -sites-channel-overflow applies")
+	flag.StringVar(&sitesOverflow, "sites-channel-overflow", "block", "What to do when -sites-buffer is full, 'block', 'drop-oldest' or 'drop-newest'")
+	flag.IntVar(&numGetConcurrent, "concurrent-event-retrieval", 1, "Number of sites each event-retrieval worker retrieves events for at once")
+	flag.IntVar(&numGetConcurrent, "get-events-parallel-sites", 1, "Alias for -concurrent-event-retrieval")
 	flag.IntVar(&numRunWorkers, "workers-run", 5, "Number of workers to run events")
+	flag.Float64Var(&runWorkersPerCPU, "run-workers-per-cpu", 0, "Number of workers to run events per CPU, overridden by -workers-run, `0` to disable")
+	flag.IntVar(&numRunWorkersMin, "workers-run-min", 0, "Number of event workers that are always running when scaling, `0` to use -workers-run")
+	flag.BoolVar(&eventQueuePriority, "event-queue-priority", false, "Hand the most overdue queued events to workers first")
+	flag.IntVar(&queueBuffer, "queue-buffer", 1000, "Maximum number of events held for -event-queue-priority, `0` for unlimited")
+	flag.IntVar(&workerStartDelay, "worker-start-delay", 0, "Milliseconds between starting each event worker, spreading their first WP-CLI runs, `0` to start them together")
+	flag.IntVar(&maxWorkerIdle, "max-worker-idle-time", 0, "Seconds without an event before an event worker is retired, keeping at least -workers-run-min, `0` to never retire")
+	flag.BoolVar(&workerAffinity, "worker-affinity", false, "Always send a site's events to the same event worker, can't be used with -workers-run-max")
+	flag.IntVar(&numRunWorkersMax, "workers-run-max", 0, "Maximum number of event workers to scale up to while events are waiting, `0` to disable scaling")
+	flag.IntVar(&scaleInterval, "scale-interval", 10, "Seconds between event worker scaling checks")
+	flag.IntVar(&startupDelay, "startup-delay", 0, "Maximum milliseconds to delay startup by, derived from the hostname so each instance waits a stable amount")
 	flag.IntVar(&getEventsInterval, "get-events-interval", 60, "Seconds between event retrieval")
+	flag.IntVar(&disabledCheckInt, "disabled-check-interval", 30, "Seconds between checks for automatic execution being re-enabled, `0` to only check on retrieval")
+	flag.StringVar(&getInfoCacheFile, "get-info-cache-file", "", "File keeping the last instance info, used when `get-info` fails before it has ever succeeded, e.g. after a restart")
+	flag.IntVar(&getInfoCacheMaxAge, "get-info-cache-max-age", 3600, "Seconds after which -get-info-cache-file is too old to use, `0` for no limit")
+	flag.IntVar(&getInfoInterval, "get-info-interval", 0, "Seconds to cache the instance info for, `0` to use -get-events-interval")
+	flag.StringVar(&getEventsUserAgent, "get-events-user-agent", "", "User agent passed to WP-CLI as WP_CLI_HTTP_USER_AGENT when retrieving events and instance info")
+	flag.BoolVar(&getInfoEveryTick, "get-info-on-every-tick", false, "Bypass the -get-info-interval cache and call `get-info` before every site retrieval, spawning many more WP-CLI processes")
+	flag.IntVar(&eventTimeout, "event-timeout", 0, "Seconds before a running event's WP-CLI process is killed, `0` to disable")
+	flag.StringVar(&eventActionTimeouts, "event-action-timeout-map", "", "JSON map of action globs to -event-timeout overrides in seconds, e.g. `{\"import_*\":300}`; the longest matching glob wins")
+	flag.BoolVar(&runEventStdin, "event-run-stdin", false, "Pass each event's timestamp, action and instance to WP-CLI as JSON on stdin, keeping them out of process listings")
+	flag.BoolVar(&runEventWithPHP, "run-event-with-php", false, "Run events with -run-event-php-script instead of WP-CLI, requires -wp-cli-php to be PHP 7.4+")
+	flag.StringVar(&runEventPHPScript, "run-event-php-script", "/usr/local/bin/cron-control-run-event.php", "Path to the `run-event.php` shim used by -run-event-with-php")
+	flag.StringVar(&wpCliCacheDir, "wpcli-cache-dir", "", "WP-CLI cache directory for this runner, created if missing, omit to use WP-CLI's default")
+	flag.StringVar(&eventRunEnvFile, "event-run-env-file", "", "File of KEY=VALUE lines added to the environment of event runs, reloaded on SIGHUP")
+	flag.StringVar(&eventRunCwd, "event-run-cwd", "", "Working directory for WP-CLI processes, omit to inherit the runner's")
+	flag.IntVar(&eventDedupInFlightTTL, "event-dedup-ttl", 300, "Seconds after which a running event stops blocking duplicates of itself, `0` to never expire")
+	flag.IntVar(&eventDedupSweepInterval, "event-dedup-sweep-interval", 60, "Seconds between checks for expired -event-dedup-ttl entries")
+	flag.IntVar(&eventRetryCount, "event-retry-count", 0, "Times to re-run a failed event before counting it as an error")
+	flag.IntVar(&eventRetryDelay, "event-retry-delay", 1000, "Milliseconds to wait before re-running a failed event")
+	flag.StringVar(&eventLog, "event-log", "", "Path to append every event run's outcome to, omit to disable")
+	flag.StringVar(&eventLogFormat, "event-log-format", "json", "Format of -event-log, 'json' for JSON lines or 'csv'")
+	flag.StringVar(&getEventsFailureLog, "get-events-failure-log", "", "Path to append failed event retrievals to as JSON lines, omit to disable")
+	flag.StringVar(&deadLetterLog, "dead-letter-log", "", "Path to append events that fail every attempt to as JSON lines, omit to disable")
+	flag.BoolVar(&eventURLValidate, "event-url-validate", false, "Skip events whose URL is not http(s) or whose host differs from the site they were retrieved from")
+	flag.BoolVar(&eventInstanceValidate, "event-instance-validate", false, "Skip events whose instance is not an MD5 hash")
+	flag.BoolVar(&eventActionSanitize, "event-action-sanitize", false, "Percent-encode URL-special characters in event action names")
+	flag.IntVar(&eventBatchSize, "event-batch-size", 0, "Number of due events to retrieve per site, `0` to use the plugin default")
+	flag.BoolVar(&getEventsStrict, "get-events-parse-strict", false, "Reject event lists from WP-CLI containing keys other than an event's fields")
+	flag.IntVar(&eventTsTolerance, "event-timestamp-tolerance", 0, "Seconds in the future an event may be scheduled for and still run, to allow for clock skew")
+	flag.StringVar(&eventOrder, "event-order", "as-returned", "Order to queue each site's events in, 'as-returned', 'timestamp-asc' or 'timestamp-desc'")
+	flag.StringVar(&eventActionLogSampling, "event-action-log-sampling", "", "JSON map of action globs to the share of their runs to debug log, e.g. `{\"publish_*\":0.01}`")
+	flag.StringVar(&eventConcurrencyKey, "event-concurrency-key", "", "Go template grouping events for -event-action-rate-limit, e.g. `{{.Action}}-{{slice .Instance 0 8}}`, omit to group by action")
+	flag.StringVar(&eventActionRateLimit, "event-action-rate-limit", "", "JSON map of action globs to maximum runs per minute, e.g. `{\"publish_*\":10}`")
+	flag.IntVar(&maxRunWorkersPerSite, "max-run-workers-per-site", 0, "Maximum number of event workers running events for the same site, `0` for unlimited")
+	flag.IntVar(&maxEventQueueWait, "max-event-queue-wait", 0, "Milliseconds to wait for a free event worker before dropping an event, `0` to wait indefinitely")
+	flag.IntVar(&maxConsecutiveErrors, "max-consecutive-errors", 0, "Consecutive WP-CLI failures before the runner exits to be restarted, `0` to disable")
+	flag.IntVar(&maxMemoryMB, "max-memory-mb", 0, "Heap size in MB above which the runner exits to be restarted, `0` to disable")
+	flag.IntVar(&memoryPollInterval, "memory-poll-interval", 30, "Seconds between heap size checks for -max-memory-mb")
+	flag.IntVar(&selfTestInterval, "self-test-interval", 0, "Seconds between checks that WP-CLI can still reach WordPress, `0` to disable")
+	flag.IntVar(&selfTestFailures, "self-test-failures", 3, "Consecutive failed self-tests before reporting an error")
+	flag.BoolVar(&selfTestRestartOnFailure, "self-test-restart-on-failure", false, "Exit to be restarted once -self-test-failures consecutive self-tests fail")
 	flag.Int64Var(&heartbeatInt, "heartbeat", 60, "Heartbeat interval in seconds")
+	flag.IntVar(&reportInterval, "report-interval", 0, "Seconds between status file snapshots and rolling success rate buckets, `0` to use -heartbeat")
+	flag.BoolVar(&disableHeartbeatReset, "disable-heartbeat-reset", false, "Keep the succeeded and errored event counters increasing across heartbeats, logging the difference since the last one")
+	flag.BoolVar(&heartbeatIncludeWorkerStats, "heartbeat-include-worker-stats", false, "Include per-worker succeeded event counts in heartbeat lines")
+	flag.IntVar(&heartbeatActionStats, "heartbeat-per-action-stats", 0, "Include the N actions with the most successful runs in heartbeat lines, `0` to disable")
+	flag.StringVar(&heartbeatSlackWebhook, "heartbeat-slack-webhook", "", "Slack Incoming Webhook URL to post each heartbeat summary to, omit to disable")
+	flag.BoolVar(&heartbeatSlackOnErrorOnly, "heartbeat-slack-on-error-only", false, "Only post heartbeats with errored events to Slack")
+	flag.IntVar(&heartbeatSlackTimeout, "heartbeat-slack-timeout", 5, "Seconds to wait for Slack to accept a heartbeat")
+	flag.StringVar(&heartbeatFile, "heartbeat-to-file", "", "Path to a file overwritten with the latest heartbeat as JSON, omit to disable")
+	flag.BoolVar(&eventsChannelTelemetry, "events-channel-telemetry", false, "Log event channel fill and send/receive totals every heartbeat interval")
+	flag.StringVar(&statusFile, "status-file", "", "Path to a JSON status file rewritten on every heartbeat, omit to disable")
 	flag.StringVar(&logDest, "log", "os.Stdout", "Log path, omit to log to Stdout")
 	flag.StringVar(&logFormat, "log-format", "JSON", "Log format, 'Text' or 'JSON'")
 	flag.BoolVar(&debug, "debug", false, "Include additional log data for debugging")
+	flag.BoolVar(&trace, "trace", false, "Log every goroutine, channel and worker state transition, implies -debug and greatly reduces throughput")
+	flag.BoolVar(&logEvents, "log-event-retrieval", false, "Log every event retrieved for each site, without enabling -debug")
+	flag.BoolVar(&logEvtArgs, "log-event-args", false, "With -debug, log the WP-CLI arguments of every event run")
+	flag.BoolVar(&logRedactSiteURLs, "log-redact-site-urls", false, "Replace site URLs in logs with site-NNNN tokens. With -debug, every token's URL is logged once after the first site list is retrieved, and tokens for sites added later are logged as they appear")
+	flag.StringVar(&logRedact, "log-redact-args", "", "Comma-separated argument prefixes, e.g. `--user`, whose values are redacted from logged WP-CLI arguments")
+	flag.BoolVar(&logCliArgs, "log-wp-cli-args", false, "Log the full argument list of every WP-CLI command before running it")
+	flag.BoolVar(&logCaller, "log-caller", true, "Include the caller file and line in Text log entries")
+	flag.BoolVar(&logSourceLoc, "log-source-location", false, "Include the calling package and function name in log entries")
+	flag.BoolVar(&logMicroseconds, "log-microseconds", false, "Include microseconds in log timestamps")
+	flag.BoolVar(&logUTC, "log-utc", true, "Use UTC rather than local time in Text log timestamps")
+	flag.StringVar(&instanceLabel, "instance-label", "", "`key=value` label added to JSON logs, heartbeats and Slack posts")
+	flag.StringVar(&cloudMetadataURL, "cloud-metadata-url", "", "URL of a metadata endpoint returning instance labels as a flat JSON object, added to JSON logs and heartbeats")
+	flag.StringVar(&instanceID, "instance-id", "", "Identifier included in all log output, omit to derive from the hostname and PID")
 	flag.BoolVar(&smartSiteList, "smart-site-list", false, "Use the `wp cron-control orchestrate` command instead of `wp site list`")
+	flag.StringVar(&multisiteExtraFields, "multisite-extra-fields", "", "Comma-separated extra `wp site list` fields to retrieve, e.g. `blog_id,blogname`")
+	flag.StringVar(&multisiteIncludeIDs, "multisite-include-blog-ids", "", "Comma-separated blog IDs to run events for, requires -multisite-extra-fields=blog_id")
+	flag.StringVar(&multisiteExcludeIDs, "multisite-exclude-blog-ids", "", "Comma-separated blog IDs to skip, requires -multisite-extra-fields=blog_id")
+	flag.StringVar(&multisiteNetworkIDs, "multisite-network-id-allowlist", "", "Comma-separated network IDs to retrieve sites for with `wp site list`, omit for all networks")
+	flag.StringVar(&multisiteDomains, "multisite-domains-only", "", "Only run events for sites whose domain matches this glob, e.g. `*.example.com`, or a regexp between slashes")
+	flag.IntVar(&multisiteBlogLimit, "multisite-blog-limit", 0, "Most sites returned by `wp site list` each cycle, `0` for no limit")
+	flag.StringVar(&multisiteSort, "multisite-sort", "random", "Site order, 'random', 'alpha-asc', 'alpha-desc' or 'id-asc', which requires -multisite-extra-fields=blog_id")
+	flag.StringVar(&multisiteNetworkIDURL, "multisite-network-id-from-url", "", "Regexp with a named group `id` extracting each site's network ID from its URL, overriding -network for event runs")
+	flag.StringVar(&siteListSource, "site-list-source", "", "File path or http(s) URL returning the multisite site list as JSON, omit to use WP-CLI")
+	flag.IntVar(&siteListSourceTimeout, "site-list-source-timeout", 10, "Seconds to wait for an HTTP site list source")
+	flag.StringVar(&multisiteAPIURL, "multisite-api-url", "", "http(s) URL of a site registry API returning the multisite site list as JSON, omit to use WP-CLI")
+	flag.StringVar(&multisiteAPIToken, "multisite-api-token", "", "Bearer token sent to -multisite-api-url")
+	flag.BoolVar(&multisiteAPIFallback, "multisite-api-fallback", false, "Retrieve the site list with WP-CLI when -multisite-api-url fails")
+	flag.IntVar(&siteCacheTTL, "site-cache-ttl", 0, "Seconds to reuse the -multisite-api-url site list, `0` to fetch it every time")
+	flag.StringVar(&siteURLScheme, "site-url-scheme-enforce", "none", "How to handle http:// site URLs, 'none', 'https' to upgrade them or 'reject' to skip them")
+	flag.BoolVar(&siteURLOverride, "allow-site-url-override", false, "Run events at the URL returned with them, if any, instead of the URL of the site they were retrieved from")
+	flag.BoolVar(&siteURLStripWww, "site-url-strip-www", false, "Treat `www.` and non-www site URLs as the same site, processing only the first one listed")
+	flag.BoolVar(&drainOnSigterm, "drain-on-sigterm", false, "On SIGTERM stop retrieving events but finish queued ones before exiting, a second SIGTERM exits immediately")
+	flag.StringVar(&checkpointFile, "checkpoint-file", "", "Path to persist runner state for crash recovery, omit to disable")
+	flag.IntVar(&checkpointInterval, "checkpoint-interval", 30, "Seconds between checkpoint writes")
 	flag.StringVar(&gRemoteToken, "token", "", "Token to authenticate remote WP CLI requests")
 	flag.IntVar(&gGuidLength, "guid-len", 36, "Sets the Guid length in use for remote WP CLI requests")
+	flag.BoolVar(&jsonEvents, "json-events", false, "Read events from stdin as newline-delimited JSON instead of retrieving them with WP-CLI, exiting once stdin is closed")
+	flag.BoolVar(&runOnce, "run-once", false, "Run due events for every site once, then exit")
+	flag.BoolVar(&configDump, "config-dump", false, "Print the resolved configuration as JSON and exit")
+}
+
+// parseFlags parses and validates the command line, it runs from main() rather than
+// init() so that tests can load the package without the runner's flags
+func parseFlags() {
 	flag.Parse()
 
+	readFlagFiles()
+	setUpInstanceID()
+	setUpInstanceLabel()
+	if trace {
+		debug = true
+	}
+	if configDump {
+		dumpConfig()
+	}
 	setUpLogger()
+	fetchCloudLabels()
 
 	// TODO: Should check for wp-config.php instead?
+	resolveWpCliPath()
 	validatePath(&wpCliPath, "WP-CLI path")
 	validatePath(&wpPath, "WordPress path")
+	if "" != wpCliPHP {
+		validatePath(&wpCliPHP, "WP-CLI PHP path")
+	}
+	if "" != eventRunCwd {
+		validatePath(&eventRunCwd, "WP-CLI working directory")
+	}
+	if "" != wpCliCacheDir {
+		if err := os.MkdirAll(wpCliCacheDir, 0755); err != nil {
+			fmt.Printf("Error for WP-CLI cache directory: %s\n", err.Error())
+			os.Exit(3)
+		}
+		validatePath(&wpCliCacheDir, "WP-CLI cache directory")
+	}
+	if runEventWithPHP {
+		validatePath(&runEventPHPScript, "Run event PHP script path")
+		validateRunEventPHP()
+	}
+	parseRetryExitCodes()
+	parseActionRateLimits()
+	openGetEventsFailureLog()
+	openEventLog()
+	loadEventRunEnv()
+	parseConcurrencyKey()
+	parseActionLogSampling()
+	parseActionTimeouts()
+	parsePdeathsig()
+	parseNetworkIDRegex()
+	parseBlogIDFilters()
+	if "" != multisiteNetworkIDs {
+		for _, id := range strings.Split(multisiteNetworkIDs, ",") {
+			if networkID, err := strconv.Atoi(strings.TrimSpace(id)); err != nil || networkID <= 0 {
+				fmt.Printf("Invalid network ID '%s'\n", id)
+				usage()
+			}
+		}
+	}
+
+	if "" != multisiteAPIURL {
+		if "" != siteListSource {
+			fmt.Println("Only one of -site-list-source and -multisite-api-url may be set")
+			usage()
+		}
+		if !strings.HasPrefix(multisiteAPIURL, "http://") && !strings.HasPrefix(multisiteAPIURL, "https://") {
+			fmt.Printf("Invalid multisite API URL '%s'\n", multisiteAPIURL)
+			usage()
+		}
+	}
+
+	if strings.HasPrefix(multisiteDomains, "/") && strings.HasSuffix(multisiteDomains, "/") && len(multisiteDomains) > 1 {
+		var err error
+		if gMultisiteDomainRegex, err = regexp.Compile(multisiteDomains[1 : len(multisiteDomains)-1]); err != nil {
+			fmt.Printf("Invalid multisite domain regexp '%s': %s\n", multisiteDomains, err.Error())
+			usage()
+		}
+	} else if _, err := filepath.Match(multisiteDomains, ""); err != nil {
+		fmt.Printf("Invalid multisite domain glob '%s': %s\n", multisiteDomains, err.Error())
+		usage()
+	}
+
+	if multisiteBlogLimit < 0 {
+		fmt.Printf("Invalid multisite blog limit %d\n", multisiteBlogLimit)
+		usage()
+	}
+
+	switch multisiteSort {
+	case "random", "alpha-asc", "alpha-desc":
+	case "id-asc":
+		if !extraFieldRequested("blog_id") {
+			fmt.Println("-multisite-sort id-asc requires -multisite-extra-fields=blog_id")
+			usage()
+		}
+	default:
+		fmt.Printf("Invalid multisite sort '%s'\n", multisiteSort)
+		usage()
+	}
+
+	if eventRunUlimitAS < 0 || eventRunUlimitCPU < 0 {
+		fmt.Printf("Invalid WP-CLI resource limits, as: %d cpu: %d\n", eventRunUlimitAS, eventRunUlimitCPU)
+		usage()
+	}
+	if eventRunNiceness < -20 || eventRunNiceness > 19 {
+		fmt.Printf("Invalid WP-CLI niceness %d, expected -20 to 19\n", eventRunNiceness)
+		usage()
+	}
+
+	if eventBatchSize < 0 {
+		fmt.Printf("Invalid event batch size %d\n", eventBatchSize)
+		usage()
+	}
+
+	if "as-returned" != eventOrder && "timestamp-asc" != eventOrder && "timestamp-desc" != eventOrder {
+		fmt.Printf("Invalid event order '%s'\n", eventOrder)
+		usage()
+	}
+
+	if "none" != siteURLScheme && "https" != siteURLScheme && "reject" != siteURLScheme {
+		fmt.Printf("Invalid site URL scheme enforcement '%s'\n", siteURLScheme)
+		usage()
+	}
+
+	if "" != wpColor && "auto" != wpColor && "always" != wpColor && "never" != wpColor {
+		fmt.Printf("Invalid WP-CLI color '%s'\n", wpColor)
+		usage()
+	}
+
+	if queueBuffer < 0 {
+		fmt.Printf("Invalid queue buffer %d\n", queueBuffer)
+		usage()
+	}
+
+	if sitesBuffer < 0 {
+		fmt.Printf("Invalid sites buffer %d\n", sitesBuffer)
+		usage()
+	}
+	if "block" != sitesOverflow && "drop-oldest" != sitesOverflow && "drop-newest" != sitesOverflow {
+		fmt.Printf("Invalid sites channel overflow '%s'\n", sitesOverflow)
+		usage()
+	}
+	if "block" != sitesOverflow && 0 == sitesBuffer {
+		fmt.Printf("-sites-channel-overflow %s requires -sites-buffer\n", sitesOverflow)
+		usage()
+	}
+
+	if numGetConcurrent < 1 {
+		fmt.Printf("Invalid concurrent event retrieval %d\n", numGetConcurrent)
+		usage()
+	}
+	validateRunUser()
+	if runEventStdin && !runEventWithPHP {
+		validateRunEventStdin()
+	}
+	setUpRunWorkersPerCPU()
+
+	if workerAffinity && numRunWorkersMax > numRunWorkers {
+		fmt.Println("-worker-affinity can't be combined with -workers-run-max")
+		usage()
+	}
+	if workerAffinity && maxWorkerIdle > 0 {
+		fmt.Println("-worker-affinity can't be combined with -max-worker-idle-time")
+		usage()
+	}
+
+	if numRunWorkersMax > 0 && numRunWorkersMin > 0 {
+		numRunWorkers = numRunWorkersMin
+	}
 
 	gRandomDeltaMap = make(map[string]int64)
 }
 
 func main() {
-	logger.Printf("Starting with %d event-retreival worker(s) and %d event worker(s)", numGetWorkers, numRunWorkers)
+	parseFlags()
+
+	if startupDelay > 0 {
+		delay := instanceStartupDelay()
+		logger.Printf("Delaying startup by %s", delay)
+		time.Sleep(delay)
+	}
+
+	logger.Printf("Starting instance %s with %d event-retreival worker(s) and %d event worker(s)", instanceID, numGetWorkers, numRunWorkers)
 	logger.Printf("Retrieving events every %d seconds", getEventsInterval)
-	go setupSignalHandler()
 
-	sites := make(chan site)
+	var ctx, drainCtx context.Context
+	ctx, gCancel = context.WithCancel(context.Background())
+	drainCtx, gDrain = context.WithCancel(ctx)
+	go setupSignalHandler()
+	gRollingWindow = NewRollingWindow(reportDuration())
+	go gRollingWindow.Run(ctx)
+	go reportPeriodically(ctx)
+	go watchMemory(ctx)
+	go watchSelfTest(ctx)
+	go gEventTracker.Sweep(ctx)
+	go watchDisabledState(ctx)
+
+	loadCheckpoint()
+	go checkpointPeriodically(ctx)
+
+	sites := make(chan site, sitesBuffer)
 	events := make(chan event)
 
-	gEventRetrieversRunning = make([]bool, numGetWorkers)
-	gEventWorkersRunning = make([]bool, numRunWorkers)
+	gSiteCounts = make(chan int, 1)
+	gRetryEvents = make(chan event)
+	if sitesPerWorker > 0 && numGetWorkersMax > numGetWorkers {
+		gEventRetrieversRunning = make([]bool, numGetWorkersMax)
+	} else {
+		gEventRetrieversRunning = make([]bool, numGetWorkers)
+	}
+	if numRunWorkersMax > numRunWorkers {
+		gEventWorkersRunning = make([]bool, numRunWorkersMax)
+	} else {
+		gEventWorkersRunning = make([]bool, numRunWorkers)
+	}
+	workerSuccessCounts = make([]uint64, len(gEventWorkersRunning))
+
+	if runOnce {
+		runAllEventsOnce(ctx)
+	}
+
+	if eventsChannelTelemetry {
+		go channelTelemetry(ctx)
+	}
 
-	go spawnEventRetrievers(sites, events)
-	go spawnEventWorkers(events)
-	go retrieveSitesPeriodically(sites)
+	go spawnEventWorkers(ctx, events)
+	if jsonEvents {
+		go readJSONEvents(ctx, events)
+	} else {
+		go spawnEventRetrievers(ctx, sites, events)
+		go retrieveSitesPeriodically(drainCtx, sites)
+	}
 
 	// Only listen for connections from remote WP CLI commands is we have a token set
 	if 0 < len(gRemoteToken) {
 		go waitForConnect()
 	}
 
-	heartbeat(sites, events)
+	heartbeat(ctx, sites, events)
+	if 0 == atomic.LoadInt32(&gExitCode) {
+		removeCheckpoint()
+	}
+	closeRunLogs()
+	os.Exit(int(atomic.LoadInt32(&gExitCode)))
 }
 
-func spawnEventRetrievers(sites <-chan site, queue chan<- event) {
+func spawnEventRetrievers(ctx context.Context, sites <-chan site, queue chan<- event) {
 	for w := 1; w <= numGetWorkers; w++ {
-		go queueSiteEvents(w, sites, queue)
+		go queueSiteEvents(ctx, w, sites, queue)
+	}
+
+	if sitesPerWorker <= 0 {
+		return
+	}
+
+	spawned := numGetWorkers
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case siteCount := <-gSiteCounts:
+			wanted := (siteCount + sitesPerWorker - 1) / sitesPerWorker
+			if wanted > len(gEventRetrieversRunning) {
+				wanted = len(gEventRetrieversRunning)
+			}
+
+			if wanted > spawned {
+				logger.Printf("%d sites found, scaling event-retrieval workers from %d to %d", siteCount, spawned, wanted)
+			}
+			for ; spawned < wanted; spawned++ {
+				go queueSiteEvents(ctx, spawned+1, sites, queue)
+			}
+		}
 	}
 }
 
-func spawnEventWorkers(queue <-chan event) {
+func spawnEventWorkers(ctx context.Context, queue <-chan event) {
+	if eventQueuePriority {
+		queue = prioritizeEvents(queue)
+	}
+
+	if workerAffinity {
+		spawnAffinityEventWorkers(ctx, queue)
+		return
+	}
+
 	workerEvents := make(chan event)
 
 	for w := 1; w <= numRunWorkers; w++ {
-		go runEvents(w, workerEvents)
+		gEventWorkersRunning[w-1] = true
+		go startEventWorker(ctx, w, workerEvents)
+	}
+
+	if numRunWorkersMax > numRunWorkers && scaleInterval > 0 {
+		go scaleWorkers(ctx, workerEvents)
 	}
 
 	for event := range queue {
+		traceLog("received job %d|%s|%s for %s from retrievers", event.Timestamp, event.Action, event.Instance, event.URL)
+		atomic.AddUint64(&eventsReceivedTotal, 1)
+		atomic.AddInt64(&gPendingEvents, 1)
 		workerEvents <- event
+		traceLog("handed job %d|%s|%s for %s to a worker", event.Timestamp, event.Action, event.Instance, event.URL)
 	}
 
 	close(workerEvents)
 }
 
-func retrieveSitesPeriodically(sites chan<- site) {
+// startEventWorker runs an initial event worker after waiting `workerID` times -worker-start-delay,
+// so workers start one by one rather than all running WP-CLI at once
+func startEventWorker(ctx context.Context, workerID int, events <-chan event) {
+	if workerStartDelay > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(workerID*workerStartDelay) * time.Millisecond):
+		}
+	}
+
+	runEvents(ctx, workerID, events, nil)
+}
+
+// spawnAffinityEventWorkers gives each event worker its own channel and routes events
+// by a hash of their site URL, so a site's events always run on the same worker
+func spawnAffinityEventWorkers(ctx context.Context, queue <-chan event) {
+	workerEvents := make([]chan event, numRunWorkers)
+	for w := 1; w <= numRunWorkers; w++ {
+		workerEvents[w-1] = make(chan event)
+	}
+	// Set before any worker starts, retries are routed with it
+	gAffinityEvents = workerEvents
+	for w := 1; w <= numRunWorkers; w++ {
+		gEventWorkersRunning[w-1] = true
+		go startEventWorker(ctx, w, workerEvents[w-1])
+	}
+
+	for {
+		var event event
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok = <-queue:
+		}
+		if !ok {
+			return
+		}
+
+		traceLog("received job %d|%s|%s for %s from retrievers", event.Timestamp, event.Action, event.Instance, event.URL)
+		atomic.AddUint64(&eventsReceivedTotal, 1)
+		atomic.AddInt64(&gPendingEvents, 1)
+
+		w := affinityWorker(event.URL)
+		select {
+		case <-ctx.Done():
+			return
+		case workerEvents[w] <- event:
+		}
+		traceLog("handed job %d|%s|%s for %s to worker %d", event.Timestamp, event.Action, event.Instance, event.URL, w+1)
+	}
+}
+
+// affinityWorker is the index of the -worker-affinity worker that runs the site's events
+func affinityWorker(siteURL string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(siteURL))
+	return int(hash.Sum32() % uint32(len(gAffinityEvents)))
+}
+
+func retrieveSitesPeriodically(ctx context.Context, sites chan site) {
+	traceLog("enter retrieveSitesPeriodically")
+	defer traceLog("exit retrieveSitesPeriodically")
 	gSiteRetrieverRunning = true
 
 	for {
-		waitForEpoch("retrieveSitesPeriodically", int64(getEventsInterval))
-		if gRestart {
+		waitForEpoch(ctx, "retrieveSitesPeriodically", int64(getEventsInterval))
+		if ctx.Err() != nil {
 			logger.Println("exiting site retriever")
 			break
 		}
 		siteList, err := getSites()
+		for retry := 1; err != nil && sitesRefreshOnError && retry <= sitesRefreshMaxRetries; retry++ {
+			logger.Printf("WARNING: error retrieving sites, retrying in %dms (attempt %d of %d): %s\n", sitesRefreshErrorDelay, retry, sitesRefreshMaxRetries, err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(sitesRefreshErrorDelay) * time.Millisecond):
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			siteList, err = getSites()
+		}
 		if err != nil {
 			continue
 		}
+		setLastSiteList(siteList)
+
+		if sitesPerWorker > 0 {
+			select {
+			case gSiteCounts <- len(siteList):
+			default:
+			}
+		}
 
 		for _, site := range siteList {
-			sites <- site
+			if ctx.Err() != nil {
+				break
+			}
+			traceLog("sending site %s", site.URL)
+			sendSite(sites, site)
+			traceLog("sent site %s", site.URL)
 		}
 	}
 
 	gSiteRetrieverRunning = false
 }
 
-func heartbeat(sites chan<- site, queue chan<- event) {
+// sendSite queues a site for the event retrievers, applying -sites-channel-overflow once -sites-buffer is full
+func sendSite(sites chan site, s site) {
+	switch sitesOverflow {
+	case "drop-newest":
+		select {
+		case sites <- s:
+		default:
+			logger.Printf("WARNING: sites buffer full, dropping %s", s.URL)
+		}
+	case "drop-oldest":
+		for {
+			select {
+			case sites <- s:
+				return
+			default:
+			}
+
+			select {
+			case dropped := <-sites:
+				logger.Printf("WARNING: sites buffer full, dropping %s", dropped.URL)
+			default:
+			}
+		}
+	default:
+		sites <- s
+	}
+}
+
+func heartbeat(ctx context.Context, sites chan<- site, queue chan<- event) {
 	if heartbeatInt == 0 {
 		logger.Println("heartbeat disabled")
 		for {
-			waitForEpoch("heartbeat", 60)
-			if gRestart {
+			waitForEpoch(ctx, "heartbeat", 60)
+			if ctx.Err() != nil {
 				logger.Println("exiting heartbeat routine")
 				break
 			}
@@ -170,9 +902,11 @@ func heartbeat(sites chan<- site, queue chan<- event) {
 		return
 	}
 
+	var lastSuccessCount, lastErrCount uint64
 	for {
-		waitForEpoch("heartbeat", heartbeatInt)
-		if gRestart {
+		waitForEpoch(ctx, "heartbeat", heartbeatInt)
+		if ctx.Err() != nil {
+			writeStatusFile(true)
 			logger.Println("exiting heartbeat routine")
 			break
 		}
@@ -183,9 +917,71 @@ func heartbeat(sites chan<- site, queue chan<- event) {
 		}
 
 		successCount, errCount := atomic.LoadUint64(&eventRunSuccessCount), atomic.LoadUint64(&eventRunErrCount)
-		atomic.SwapUint64(&eventRunSuccessCount, 0)
-		atomic.SwapUint64(&eventRunErrCount, 0)
-		logger.Printf("eventsSucceededSinceLast=%d eventsErroredSinceLast=%d", successCount, errCount)
+		droppedCount := atomic.SwapUint64(&eventDroppedCount, 0)
+		invalidCount := atomic.SwapUint64(&eventInvalidCount, 0)
+		schemeRejectedCount := atomic.SwapUint64(&siteSchemeRejectedCount, 0)
+		if disableHeartbeatReset {
+			lastSuccessCount, successCount = successCount, successCount-lastSuccessCount
+			lastErrCount, errCount = errCount, errCount-lastErrCount
+		} else {
+			atomic.SwapUint64(&eventRunSuccessCount, 0)
+			atomic.SwapUint64(&eventRunErrCount, 0)
+			atomic.AddUint64(&eventRunSuccessTotal, successCount)
+			atomic.AddUint64(&eventRunErrTotal, errCount)
+		}
+		writeStatusFile(false)
+
+		rate5m, _, _ := gRollingWindow.Rate(5)
+		rate15m, _, _ := gRollingWindow.Rate(15)
+		rate60m, _, _ := gRollingWindow.Rate(60)
+
+		workerStats := ""
+		var workerCounts []uint64
+		if heartbeatIncludeWorkerStats {
+			workerCounts = make([]uint64, len(workerSuccessCounts))
+			counts := make([]string, len(workerSuccessCounts))
+			for i := range workerSuccessCounts {
+				workerCounts[i] = atomic.SwapUint64(&workerSuccessCounts[i], 0)
+				counts[i] = strconv.FormatUint(workerCounts[i], 10)
+			}
+			workerStats = fmt.Sprintf(" workers=[%s]", strings.Join(counts, ","))
+		}
+
+		actionStats := ""
+		var actionCounts []ActionCount
+		if heartbeatActionStats > 0 {
+			actionCounts = topActionCounts()
+			actionStats = formatActionCounts(actionCounts)
+		}
+
+		if maxMemoryMB > 0 {
+			var memStats runtime.MemStats
+			runtime.ReadMemStats(&memStats)
+			var usage syscall.Rusage
+			syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+			// Maxrss is the peak in KB, the current RSS comes from /proc
+			logger.Printf("heapAllocMB=%d rssMB=%d peakRssMB=%d", memStats.HeapAlloc/1024/1024, currentRSS()/1024/1024, usage.Maxrss/1024)
+		}
+
+		summary := fmt.Sprintf("eventsSucceededSinceLast=%d eventsErroredSinceLast=%d eventsDroppedSinceLast=%d eventsInvalidSinceLast=%d sitesSchemeRejectedSinceLast=%d rate_5m=%0.3f rate_15m=%0.3f rate_60m=%0.3f%s%s",
+			successCount, errCount, droppedCount, invalidCount, schemeRejectedCount, rate5m, rate15m, rate60m, workerStats, actionStats)
+		logger.Println(summary)
+		go postHeartbeatToSlack(summary, errCount)
+		writeHeartbeatFile(HeartbeatEntry{
+			Time:            time.Now().UTC().Format(time.RFC3339),
+			InstanceID:      instanceID,
+			EventsSucceeded: successCount,
+			EventsErrored:   errCount,
+			EventsDropped:   droppedCount,
+			EventsInvalid:   invalidCount,
+			SitesRejected:   schemeRejectedCount,
+			Rate5m:          rate5m,
+			Rate15m:         rate15m,
+			Rate60m:         rate60m,
+			WorkerSucceeded: workerCounts,
+			Actions:         actionCounts,
+			Labels:          gLabels,
+		})
 	}
 
 	var StillRunning bool
@@ -204,7 +1000,11 @@ func heartbeat(sites chan<- site, queue chan<- event) {
 			if r {
 				logger.Printf("event worker ID %d still running\n", workerID+1)
 				logger.Printf("sending empty event for worker %d\n", workerID+1)
-				queue <- event{}
+				// Workers also stop on cancellation, so don't wait on one that already has
+				select {
+				case queue <- event{}:
+				default:
+				}
 				StillRunning = true
 			}
 		}
@@ -223,13 +1023,17 @@ func heartbeat(sites chan<- site, queue chan<- event) {
 			maxWaitCount--
 			continue
 		}
+		if 0 == atomic.LoadInt32(&gExitCode) {
+			removeCheckpoint()
+		}
+		closeRunLogs()
 		logger.Println(".:sayonara:.")
-		os.Exit(0)
+		os.Exit(int(atomic.LoadInt32(&gExitCode)))
 	}
 }
 
 func getSites() ([]site, error) {
-	siteInfo, err := getInstanceInfo()
+	siteInfo, err := getCachedInstanceInfo()
 	if err != nil {
 		siteInfo.Disabled = 1
 	}
@@ -242,6 +1046,17 @@ func getSites() ([]site, error) {
 		sites, err := getMultisiteSites()
 		if err != nil {
 			sites = nil
+		} else if siteURLStripWww {
+			sites = dedupSites(sites)
+		}
+		if nil != sites && "" != multisiteDomains {
+			sites = filterSiteDomains(sites)
+		}
+		for _, s := range sites {
+			registerSiteURLs(s.URL)
+		}
+		if nil == err {
+			logSiteTokens()
 		}
 
 		return sites, err
@@ -250,13 +1065,49 @@ func getSites() ([]site, error) {
 	// Mock for single site
 	sites := make([]site, 0)
 	sites = append(sites, site{URL: siteInfo.Siteurl})
+	registerSiteURLs(siteInfo.Siteurl)
+	logSiteTokens()
 
 	return sites, nil
 }
 
+// getCachedInstanceInfo only calls `get-info` once the cached result is older than -get-info-interval,
+// or every time with -get-info-on-every-tick
+func getCachedInstanceInfo() (siteInfo, error) {
+	interval := getInfoInterval
+	if interval <= 0 {
+		interval = getEventsInterval
+	}
+
+	gInfoCacheMutex.Lock()
+	defer gInfoCacheMutex.Unlock()
+
+	if !getInfoEveryTick && !gInfoCacheTime.IsZero() && time.Since(gInfoCacheTime) < time.Duration(interval)*time.Second {
+		return gInfoCache, nil
+	}
+
+	info, err := getInstanceInfo()
+	if err != nil {
+		if gInfoCacheTime.IsZero() {
+			if cached, found := readInfoCacheFile(); found {
+				logger.Printf("WARNING: get-info failed, using the instance info cached in %s: %s", getInfoCacheFile, err.Error())
+				return cached, nil
+			}
+		}
+		return info, err
+	}
+
+	if info.Version != gInfoCache.Version {
+		logger.Printf("Detected WordPress version %s", info.Version)
+	}
+	gInfoCache, gInfoCacheTime = info, time.Now()
+	return info, nil
+}
+
 func getInstanceInfo() (siteInfo, error) {
 	raw, err := runWpCliCmd([]string{"cron-control", "orchestrate", "runner-only", "get-info", "--format=json"})
 	if err != nil {
+		logWpCliError("getInstanceInfo", err)
 		return siteInfo{}, err
 	}
 
@@ -269,14 +1120,17 @@ func getInstanceInfo() (siteInfo, error) {
 		return siteInfo{}, err
 	}
 
+	writeInfoCacheFile(jsonRes[0])
 	return jsonRes[0], nil
 }
 
 func shouldGetSites(disabled int) bool {
 	if disabled == 0 {
 		atomic.SwapUint64(&disabledLoopCount, 0)
+		atomic.StoreInt32(&disabledState, 0)
 		return true
 	}
+	atomic.StoreInt32(&disabledState, 1)
 
 	disabledCount, now := atomic.LoadUint64(&disabledLoopCount), time.Now()
 	disabledSleep := time.Minute * 3 * time.Duration(disabledCount)
@@ -295,7 +1149,10 @@ func shouldGetSites(disabled int) bool {
 			logger.Printf("Automatic execution disabled, sleeping for an additional %d minutes", disabledSleepSeconds/60)
 		}
 
-		time.Sleep(disabledSleep)
+		select {
+		case <-time.After(disabledSleep):
+		case <-gReenabled:
+		}
 	} else if debug {
 		logger.Println("Automatic execution disabled")
 	}
@@ -303,13 +1160,105 @@ func shouldGetSites(disabled int) bool {
 	return false
 }
 
+// watchDisabledState polls `get-info` while automatic execution is disabled, and
+// wakes the site retriever as soon as it is enabled again
+func watchDisabledState(ctx context.Context) {
+	if disabledCheckInt <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(disabledCheckInt) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if 0 == atomic.LoadInt32(&disabledState) {
+			continue
+		}
+
+		info, err := getInstanceInfo()
+		if err != nil || 0 != info.Disabled {
+			continue
+		}
+
+		logger.Println("Automatic execution re-enabled")
+		gInfoCacheMutex.Lock()
+		gInfoCache, gInfoCacheTime = info, time.Now()
+		gInfoCacheMutex.Unlock()
+
+		atomic.SwapUint64(&disabledLoopCount, 0)
+		atomic.StoreInt32(&disabledState, 0)
+		select {
+		case gReenabled <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// filterSiteDomains keeps the sites whose domain matches -multisite-domains-only
+func filterSiteDomains(sites []site) []site {
+	filtered := make([]site, 0, len(sites))
+	for _, s := range sites {
+		parsed, err := url.Parse(s.URL)
+		if err != nil || "" == parsed.Host {
+			// Scheme-less URLs parse as a path
+			parsed = &url.URL{Host: strings.SplitN(s.URL, "/", 2)[0]}
+		}
+
+		var matched bool
+		if nil != gMultisiteDomainRegex {
+			matched = gMultisiteDomainRegex.MatchString(parsed.Hostname())
+		} else {
+			matched, _ = filepath.Match(multisiteDomains, parsed.Hostname())
+		}
+		if matched {
+			filtered = append(filtered, s)
+		}
+	}
+
+	if 0 == len(filtered) {
+		logger.Printf("WARNING: none of the %d sites match -multisite-domains-only %s", len(sites), multisiteDomains)
+	}
+	return filtered
+}
+
+func listSitesWithWpCli() (string, error) {
+	if smartSiteList {
+		return runWpCliCmd([]string{"cron-control", "orchestrate", "sites", "list"})
+	}
+
+	fields := "url"
+	if "" != multisiteExtraFields {
+		fields += "," + multisiteExtraFields
+	}
+	subcommand := []string{"site", "list", fmt.Sprintf("--fields=%s", fields), "--archived=false", "--deleted=false", "--spam=false", "--format=json"}
+	if "" != multisiteNetworkIDs {
+		subcommand = append(subcommand, fmt.Sprintf("--network__in=%s", strings.Replace(multisiteNetworkIDs, " ", "", -1)))
+	}
+	if multisiteBlogLimit > 0 {
+		subcommand = append(subcommand, fmt.Sprintf("--number=%d", multisiteBlogLimit))
+	}
+	return runWpCliCmd(subcommand)
+}
+
 func getMultisiteSites() ([]site, error) {
 	var raw string
 	var err error
-	if smartSiteList {
-		raw, err = runWpCliCmd([]string{"cron-control", "orchestrate", "sites", "list"})
+	if "" != siteListSource {
+		raw, err = readSiteListSource()
+	} else if "" != multisiteAPIURL {
+		raw, err = readSiteListAPI()
+		if err != nil && multisiteAPIFallback {
+			logger.Printf("WARNING: site list API failed, falling back to WP-CLI: %s", err.Error())
+			raw, err = listSitesWithWpCli()
+		}
 	} else {
-		raw, err = runWpCliCmd([]string{"site", "list", "--fields=url", "--archived=false", "--deleted=false", "--spam=false", "--format=json"})
+		raw, err = listSitesWithWpCli()
 	}
 
 	if err != nil {
@@ -325,128 +1274,836 @@ func getMultisiteSites() ([]site, error) {
 		return nil, err
 	}
 
-	// Shuffle site order so that none are favored
-	for i := range jsonRes {
-		j := rand.Intn(i + 1)
-		jsonRes[i], jsonRes[j] = jsonRes[j], jsonRes[i]
+	if nil != gNetworkIDRegex {
+		for i := range jsonRes {
+			jsonRes[i].NetworkID = networkIDFromURL(jsonRes[i].URL)
+		}
+	}
+
+	switch multisiteSort {
+	case "alpha-asc":
+		sort.Slice(jsonRes, func(i, j int) bool { return jsonRes[i].URL < jsonRes[j].URL })
+	case "alpha-desc":
+		sort.Slice(jsonRes, func(i, j int) bool { return jsonRes[i].URL > jsonRes[j].URL })
+	case "id-asc":
+		sort.Slice(jsonRes, func(i, j int) bool { return siteBlogID(jsonRes[i]) < siteBlogID(jsonRes[j]) })
+	default:
+		// Shuffle site order so that none are favored
+		for i := range jsonRes {
+			j := rand.Intn(i + 1)
+			jsonRes[i], jsonRes[j] = jsonRes[j], jsonRes[i]
+		}
 	}
 
 	return jsonRes, nil
 }
 
-func queueSiteEvents(workerID int, sites <-chan site, queue chan<- event) {
-	gEventRetrieversRunning[workerID-1] = true
-	logger.Printf("started retriever %d\n", workerID)
-
-OuterLoop:
-	for site := range sites {
-		if gRestart {
-			logger.Printf("exiting event retriever ID %d\n", workerID)
-			break
-		}
+// networkIDFromURL applies -multisite-network-id-from-url to a site URL, `0` if it doesn't match
+func networkIDFromURL(url string) int {
+	match := gNetworkIDRegex.FindStringSubmatch(url)
+	if nil == match {
 		if debug {
-			logger.Printf("getEvents-%d processing %s", workerID, site.URL)
+			logger.Printf("no network ID found in %s, using -network", url)
 		}
+		return 0
+	}
 
-		events, err := getSiteEvents(site.URL)
-		if err == nil && len(events) > 0 {
-			for _, event := range events {
-				if gRestart {
-					break OuterLoop
-				}
-				event.URL = site.URL
-				queue <- event
+	id, err := strconv.Atoi(match[gNetworkIDRegex.SubexpIndex("id")])
+	if err != nil || id <= 0 {
+		logger.Printf("WARNING: invalid network ID in %s, using -network", url)
+		return 0
+	}
+
+	return id
+}
+
+func parseNetworkIDRegex() {
+	if "" == multisiteNetworkIDURL {
+		return
+	}
+
+	var err error
+	if gNetworkIDRegex, err = regexp.Compile(multisiteNetworkIDURL); err != nil {
+		fmt.Printf("Invalid -multisite-network-id-from-url: %s\n", err.Error())
+		usage()
+	}
+	if gNetworkIDRegex.SubexpIndex("id") < 0 {
+		fmt.Println("-multisite-network-id-from-url requires a named group `id`")
+		usage()
+	}
+}
+
+func normalizeSiteURL(url string) string {
+	scheme := ""
+	if parts := strings.SplitN(url, "://", 2); 2 == len(parts) {
+		scheme, url = parts[0]+"://", parts[1]
+	}
+
+	return scheme + strings.TrimPrefix(url, "www.")
+}
+
+func dedupSites(sites []site) []site {
+	seen := make(map[string]struct{}, len(sites))
+	deduped := make([]site, 0, len(sites))
+
+	for _, site := range sites {
+		normalized := normalizeSiteURL(site.URL)
+		if _, found := seen[normalized]; found {
+			if debug {
+				logger.Printf("skipping duplicate site %s", site.URL)
 			}
+			continue
 		}
-		time.Sleep(getEventsBreakSec)
+
+		seen[normalized] = struct{}{}
+		deduped = append(deduped, site)
 	}
+
+	return deduped
+}
+
+func queueSiteEvents(ctx context.Context, workerID int, sites <-chan site, queue chan<- event) {
+	traceLog("enter queueSiteEvents-%d", workerID)
+	defer traceLog("exit queueSiteEvents-%d", workerID)
+	gEventRetrieversRunning[workerID-1] = true
+	traceLog("retriever %d running", workerID)
+	logger.Printf("started retriever %d\n", workerID)
+
+	// Each retriever fetches up to -concurrent-event-retrieval sites at once
+	slots := make(chan struct{}, numGetConcurrent)
+	var wg sync.WaitGroup
+
+	for s := range sites {
+		traceLog("getEvents-%d received site %s", workerID, s.URL)
+		if ctx.Err() != nil {
+			logger.Printf("exiting event retriever ID %d\n", workerID)
+			break
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(s site) {
+			defer wg.Done()
+			queueEventsForSite(ctx, workerID, s, queue)
+			time.Sleep(getEventsBreakSec)
+			<-slots
+		}(s)
+	}
+	wg.Wait()
+
 	// Mark this event retriever as not running for graceful exit
 	gEventRetrieversRunning[workerID-1] = false
+	traceLog("retriever %d stopped", workerID)
+}
+
+// filterSite applies -site-url-scheme-enforce and the blog ID filters, returning the site
+// to retrieve events for, or false if it should be skipped
+func filterSite(whom string, s site) (site, bool) {
+	if strings.HasPrefix(s.URL, "http://") {
+		switch siteURLScheme {
+		case "https":
+			s.URL = "https://" + strings.TrimPrefix(s.URL, "http://")
+			registerSiteURLs(s.URL)
+		case "reject":
+			atomic.AddUint64(&siteSchemeRejectedCount, 1)
+			logger.Printf("WARNING: %s skipping %s, http:// site URLs are rejected", whom, s.URL)
+			return s, false
+		}
+	}
+
+	if !blogIDAllowed(s) {
+		if debug {
+			logger.Printf("%s skipping %s, blog ID %s is filtered out", whom, s.URL, s.ExtraFields["blog_id"])
+		}
+		return s, false
+	}
+
+	return s, true
+}
+
+func queueEventsForSite(ctx context.Context, workerID int, site site, queue chan<- event) {
+	if debug {
+		logger.Printf("getEvents-%d processing %s", workerID, site.URL)
+	}
+
+	site, ok := filterSite(fmt.Sprintf("getEvents-%d", workerID), site)
+	if !ok {
+		return
+	}
+
+	atomic.AddInt32(&gBusyRetrievers, 1)
+	defer atomic.AddInt32(&gBusyRetrievers, -1)
+
+	events, err := getSiteEvents(site.URL)
+	if err != nil {
+		return
+	}
+	if logEvents {
+		if 0 < len(site.ExtraFields) {
+			logger.Printf("getEvents-%d retrieved %d event(s) for %s %v", workerID, len(events), site.URL, site.ExtraFields)
+		} else {
+			logger.Printf("getEvents-%d retrieved %d event(s) for %s", workerID, len(events), site.URL)
+		}
+	}
+
+	sortEvents(events)
+	for _, event := range events {
+		if ctx.Err() != nil {
+			return
+		}
+		event.URL = eventURL(workerID, event, site)
+		event.NetworkID = site.NetworkID
+		if logEvents {
+			logger.Printf("getEvents-%d retrieved job %d|%s|%s for %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
+		}
+		if err := validateEvent(event); err != nil {
+			atomic.AddUint64(&eventInvalidCount, 1)
+			logger.Printf("getEvents-%d skipping invalid job %d|%s|%s for %s: %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL, err.Error())
+			continue
+		}
+		if err := validateEventURL(event, site.URL); err != nil {
+			atomic.AddUint64(&eventInvalidCount, 1)
+			logger.Printf("WARNING: getEvents-%d skipping job %d|%s|%s with unsafe URL %q: %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL, err.Error())
+			continue
+		}
+		queueEvent(ctx, workerID, queue, event)
+	}
 }
 
+// eventURL is the site an event was retrieved from, unless -allow-site-url-override is set and the
+// event came with a valid URL of its own
+func eventURL(workerID int, e event, s site) string {
+	if !siteURLOverride || "" == e.URL {
+		return s.URL
+	}
+
+	parsed, err := url.Parse(e.URL)
+	if err != nil || ("http" != parsed.Scheme && "https" != parsed.Scheme) || "" == parsed.Host {
+		invalid := fmt.Sprintf("%q", e.URL)
+		if logRedactSiteURLs {
+			// Invalid URLs never get a token, so keep them out of redacted logs
+			invalid = "(redacted)"
+		}
+		logger.Printf("WARNING: getEvents-%d ignoring invalid URL %s for job %d|%s|%s, using %s", workerID, invalid, e.Timestamp, e.Action, e.Instance, s.URL)
+		return s.URL
+	}
+	registerSiteURLs(e.URL)
+
+	if debug && e.URL != s.URL {
+		logger.Printf("getEvents-%d job %d|%s|%s retrieved for %s overrides its URL with %s", workerID, e.Timestamp, e.Action, e.Instance, s.URL, e.URL)
+	}
+	return e.URL
+}
+
+// sortEvents applies -event-order to one site's batch of events
+func sortEvents(events []event) {
+	switch eventOrder {
+	case "timestamp-asc":
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Timestamp < events[j].Timestamp })
+	case "timestamp-desc":
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Timestamp > events[j].Timestamp })
+	}
+}
+
+func validateEvent(e event) error {
+	if "" == e.Action {
+		return errors.New("empty action")
+	}
+	for _, c := range e.Action {
+		if c < ' ' || c > '~' {
+			return fmt.Errorf("action contains non-printable character %q", c)
+		}
+	}
+
+	if e.Timestamp <= 0 {
+		return fmt.Errorf("invalid timestamp %d", e.Timestamp)
+	}
+	if time.Since(time.Unix(int64(e.Timestamp), 0)) > maxEventAge {
+		return fmt.Errorf("timestamp %d is older than %s", e.Timestamp, maxEventAge)
+	}
+
+	if "" == e.Instance {
+		return errors.New("empty instance")
+	}
+
+	return nil
+}
+
+// validateEventURL checks the URL passed to WP-CLI with -event-url-validate
+func validateEventURL(e event, siteURL string) error {
+	if !eventURLValidate {
+		return nil
+	}
+
+	parsed, err := url.Parse(e.URL)
+	if err != nil {
+		return err
+	}
+	if "http" != parsed.Scheme && "https" != parsed.Scheme {
+		return fmt.Errorf("scheme %q is not http or https", parsed.Scheme)
+	}
+	if "" == parsed.Host {
+		return errors.New("empty host")
+	}
+
+	site, err := url.Parse(siteURL)
+	if err != nil || !strings.EqualFold(site.Host, parsed.Host) {
+		return fmt.Errorf("host %q does not match the site %s", parsed.Host, siteURL)
+	}
+
+	return nil
+}
+
+func queueEvent(ctx context.Context, workerID int, queue chan<- event, event event) {
+	atomic.AddInt64(&gQueuedEvents, 1)
+	defer atomic.AddInt64(&gQueuedEvents, -1)
+	traceLog("getEvents-%d sending job %d|%s|%s for %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
+	defer traceLog("getEvents-%d finished sending job %d|%s|%s for %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
+
+	var timeout <-chan time.Time
+	if maxEventQueueWait > 0 {
+		timeout = time.After(time.Duration(maxEventQueueWait) * time.Millisecond)
+	}
+
+	select {
+	case queue <- event:
+		atomic.AddUint64(&eventsSentTotal, 1)
+	case <-ctx.Done():
+		// Shutting down, the workers are no longer taking events
+	case <-timeout:
+		atomic.AddUint64(&eventDroppedCount, 1)
+		logger.Printf("getEvents-%d dropped job %d|%s|%s for %s after waiting %dms for a free worker", workerID, event.Timestamp, event.Action, event.Instance, event.URL, maxEventQueueWait)
+	}
+}
+
+// getSiteEvents retrieves due events for one site. `list-due-batch` runs in the
+// context of the single site selected by WP-CLI's global `--url`, so sites can't
+// be batched into one call.
 func getSiteEvents(site string) ([]event, error) {
-	raw, err := runWpCliCmd([]string{"cron-control", "orchestrate", "runner-only", "list-due-batch", fmt.Sprintf("--url=%s", site), "--format=json"})
+	subcommand := []string{"cron-control", "orchestrate", "runner-only", "list-due-batch", fmt.Sprintf("--url=%s", site), "--format=json"}
+	if eventBatchSize > 0 {
+		subcommand = append(subcommand, fmt.Sprintf("--batch-size=%d", eventBatchSize))
+	}
+
+	raw, err := runWpCliCmd(subcommand)
 	if err != nil {
+		logWpCliError("getSiteEvents "+site, err)
+		writeGetEventsFailure(site, err)
 		return nil, err
 	}
 
 	siteEvents := make([]event, 0)
-	if err = json.Unmarshal([]byte(raw), &siteEvents); err != nil {
+	if getEventsStrict {
+		err = decodeEventsStrict(raw, &siteEvents)
+	} else {
+		err = json.Unmarshal([]byte(raw), &siteEvents)
+	}
+	if err != nil {
 		if debug {
 			logger.Println(fmt.Sprintf("%+v - %s", err, raw))
 		}
 
+		writeGetEventsFailure(site, err)
 		return nil, err
 	}
 
 	return siteEvents, nil
 }
 
-func runEvents(workerID int, events <-chan event) {
+// decodeEventsStrict is json.Unmarshal that fails on unknown keys or anything after the list
+func decodeEventsStrict(raw string, events *[]event) error {
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(events); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("unexpected data after the event list")
+	}
+
+	return nil
+}
+
+func runEvents(ctx context.Context, workerID int, events <-chan event, stop <-chan struct{}) {
+	traceLog("enter runEvents-%d", workerID)
+	defer traceLog("exit runEvents-%d", workerID)
 	gEventWorkersRunning[workerID-1] = true
+	traceLog("event worker %d running", workerID)
 	logger.Printf("started event worker %d\n", workerID)
+	atomic.AddInt32(&gActiveWorkers, 1)
+	retired := false
+
+	for {
+		var event event
+		var ok bool
+		var idle <-chan time.Time
+		var idleTimer *time.Timer
+		if maxWorkerIdle > 0 {
+			idleTimer = time.NewTimer(time.Duration(maxWorkerIdle) * time.Second)
+			idle = idleTimer.C
+		}
+		select {
+		case <-ctx.Done():
+			logger.Printf("exiting event worker ID %d\n", workerID)
+		case <-stop:
+			logger.Printf("retiring event worker ID %d\n", workerID)
+		case <-idle:
+			if retired = retireWorker(workerID); !retired {
+				continue
+			}
+		case event, ok = <-events:
+		case event, ok = <-gRetryEvents:
+		}
+		if nil != idleTimer {
+			idleTimer.Stop()
+		}
+		if !ok {
+			break
+		}
+		traceLog("runEvents-%d received job %d|%s|%s for %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
 
-	for event := range events {
-		if gRestart {
+		atomic.AddInt64(&gPendingEvents, -1)
+		if ctx.Err() != nil {
 			logger.Printf("exiting event worker ID %d\n", workerID)
 			break
 		}
-		if now := time.Now(); event.Timestamp > int(now.Unix()) {
+
+		if !acquireSiteWorker(event.URL) {
 			if debug {
-				logger.Printf("runEvents-%d skipping premature job %d|%s|%s for %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
+				logger.Printf("runEvents-%d requeueing job %d|%s|%s for %s, site is at its worker limit", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
 			}
+			requeueEvent(ctx, event, time.Second)
+			continue
+		}
+		ran, err := runEvent(ctx, workerID, event)
+		releaseSiteWorker(event.URL)
+		if !ran {
+			continue
+		}
+		if willRetry(event, err) {
+			scheduleRetry(ctx, workerID, event)
+		}
+
+		waitForEpoch(ctx, "runEvents", runEventsBreakSec)
+		if ctx.Err() != nil {
+			logger.Printf("exiting event worker ID %d\n", workerID)
+			break
+		}
+
+	}
+
+	// Mark this event worker as not running for graceful exit
+	gEventWorkersRunning[workerID-1] = false
+	if !retired {
+		atomic.AddInt32(&gActiveWorkers, -1)
+	}
+	traceLog("event worker %d stopped", workerID)
+}
+
+// retireWorker takes an idle event worker out of the active count, unless that would
+// leave fewer than -workers-run-min (at least one) running
+func retireWorker(workerID int) bool {
+	floor := int32(numRunWorkersMin)
+	if floor < 1 {
+		floor = 1
+	}
+
+	for {
+		active := atomic.LoadInt32(&gActiveWorkers)
+		if active <= floor {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&gActiveWorkers, active, active-1) {
+			break
+		}
+	}
+
+	logger.Printf("retiring event worker ID %d after %ds idle\n", workerID, maxWorkerIdle)
+	return true
+}
+
+// runEvent runs a single event, returning false if it was skipped
+func runEvent(ctx context.Context, workerID int, event event) (bool, error) {
+	// Errors are always logged, -event-action-log-sampling only thins out debug lines
+	logDebug := debug && sampleLogEvent(event.Action)
+
+	if now := time.Now(); event.Timestamp > int(now.Unix())+eventTsTolerance {
+		if logDebug {
+			logger.Printf("runEvents-%d skipping premature job %d|%s|%s for %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
+		}
+
+		return false, nil
+	}
+
+	if eventInstanceValidate && !eventInstanceRegex.MatchString(event.Instance) {
+		logger.Printf("ERROR: runEvents-%d skipping job %d|%s|%q for %s with invalid instance", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
+		return false, nil
+	}
+
+	if !gEventTracker.Start(event) {
+		if logDebug {
+			logger.Printf("runEvents-%d skipping duplicate job %d|%s|%s for %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
+		}
+
+		return false, nil
+	}
+
+	if limiter := actionLimiter(concurrencyKey(event)); nil != limiter {
+		if err := limiter.Wait(ctx); err != nil {
+			gEventTracker.Finish(event, false)
+			return false, nil
+		}
+	}
+
+	action := event.Action
+	if eventActionSanitize {
+		action = url.QueryEscape(event.Action)
+		if action != event.Action {
+			logger.Printf("WARNING: runEvents-%d sanitized action %q to %q for %s", workerID, event.Action, action, event.URL)
+		}
+	}
 
+	subcommand := []string{"cron-control", "orchestrate", "runner-only", "run", fmt.Sprintf("--timestamp=%d", event.Timestamp),
+		fmt.Sprintf("--action=%s", action), fmt.Sprintf("--instance=%s", event.Instance), fmt.Sprintf("--url=%s", event.URL)}
+	var input []byte
+	if runEventStdin {
+		// WP-CLI still needs `--url` to load the right site
+		subcommand = []string{"cron-control", "orchestrate", "runner-only", "run", "--stdin", fmt.Sprintf("--url=%s", event.URL)}
+		input, _ = json.Marshal(map[string]interface{}{"timestamp": event.Timestamp, "action": action, "instance": event.Instance, "url": event.URL})
+	}
+	if event.NetworkID > 0 {
+		subcommand = append(subcommand, fmt.Sprintf("--network=%d", event.NetworkID))
+	}
+
+	if logDebug && logEvtArgs {
+		logger.Printf("runEvents-%d running job %d|%s|%s for %s with %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL, strings.Join(redactWpCliArgs(subcommand), " "))
+	}
+
+	timeout := actionTimeout(event.Action)
+	start := time.Now()
+	_, err := runWpCliCmdInput(subcommand, time.Duration(timeout)*time.Second, input)
+	writeEventRun(event, err, time.Since(start))
+	gEventTracker.Finish(event, !willRetry(event, err))
+	switch err.(type) {
+	case *WpCliTimeoutError:
+		logger.Printf("ERROR: runEvents-%d job %d|%s|%s for %s killed after exceeding the %ds timeout", workerID, event.Timestamp, event.Action, event.Instance, event.URL, timeout)
+	case *WpCliNotFoundError:
+		logger.Printf("ERROR: runEvents-%d job %d|%s|%s for %s not run: %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL, err.Error())
+	}
+	gRollingWindow.Record(err == nil)
+
+	if err == nil {
+		if heartbeatInt > 0 {
+			atomic.AddUint64(&eventRunSuccessCount, 1)
+			atomic.AddUint64(&workerSuccessCounts[workerID-1], 1)
+			recordActionSuccess(event.Action)
+		}
+
+		if logDebug {
+			logger.Printf("runEvents-%d finished job %d|%s|%s for %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
+		}
+	} else if !willRetry(event, err) {
+		if heartbeatInt > 0 {
+			atomic.AddUint64(&eventRunErrCount, 1)
+		}
+		writeDeadLetter(event, err)
+	}
+
+	return true, err
+}
+
+// logWpCliError logs failures that need attention regardless of -debug
+func logWpCliError(whom string, err error) {
+	switch err := err.(type) {
+	case *WpCliNotFoundError:
+		logger.Printf("ERROR: %s: %s", whom, err.Error())
+	case *WpCliTimeoutError:
+		logger.Printf("%s: %s", whom, err.Error())
+	case *WpCliExitError:
+		if debug {
+			logger.Printf("%s: %s - %s", whom, err.Error(), err.Output)
+		}
+	}
+}
+
+func hasRetriesLeft(e event) bool {
+	return e.Attempts < eventRetryCount
+}
+
+// willRetry reports whether a failed run is re-run, a missing WP-CLI binary won't
+// fix itself so those failures are never retried
+func willRetry(e event, err error) bool {
+	if nil == err {
+		return false
+	}
+	if _, notFound := err.(*WpCliNotFoundError); notFound {
+		return false
+	}
+
+	return hasRetriesLeft(e)
+}
+
+// scheduleRetry hands a failed event back to the workers once the retry delay passes
+func scheduleRetry(ctx context.Context, workerID int, e event) {
+	e.Attempts++
+	logger.Printf("runEvents-%d retrying job %d|%s|%s for %s in %dms (attempt %d of %d)", workerID, e.Timestamp, e.Action, e.Instance, e.URL, eventRetryDelay, e.Attempts, eventRetryCount)
+
+	requeueEvent(ctx, e, time.Duration(eventRetryDelay)*time.Millisecond)
+}
+
+// requeueEvent hands an event back to the workers after `delay`, or to the worker
+// owning its site with -worker-affinity
+func requeueEvent(ctx context.Context, e event, delay time.Duration) {
+	retries := gRetryEvents
+	if nil != gAffinityEvents {
+		retries = gAffinityEvents[affinityWorker(e.URL)]
+	}
+
+	atomic.AddInt64(&gPendingEvents, 1)
+	time.AfterFunc(delay, func() {
+		select {
+		case retries <- e:
+		case <-ctx.Done():
+			// Shutting down, the workers are no longer taking events
+			atomic.AddInt64(&gPendingEvents, -1)
+		}
+	})
+}
+
+// acquireSiteWorker reserves a worker slot for the site, returning false if
+// -max-run-workers-per-site are already running its events
+func acquireSiteWorker(siteURL string) bool {
+	if maxRunWorkersPerSite <= 0 {
+		return true
+	}
+
+	gSiteWorkerMutex.Lock()
+	defer gSiteWorkerMutex.Unlock()
+
+	if gSiteWorkerCounts[siteURL] >= maxRunWorkersPerSite {
+		return false
+	}
+	gSiteWorkerCounts[siteURL]++
+	return true
+}
+
+func releaseSiteWorker(siteURL string) {
+	if maxRunWorkersPerSite <= 0 {
+		return
+	}
+
+	gSiteWorkerMutex.Lock()
+	// Drop idle sites so the map only holds sites with running events
+	if gSiteWorkerCounts[siteURL]--; gSiteWorkerCounts[siteURL] <= 0 {
+		delete(gSiteWorkerCounts, siteURL)
+	}
+	gSiteWorkerMutex.Unlock()
+}
+
+// readJSONEvents queues events read from stdin, one JSON object per line
+func readJSONEvents(ctx context.Context, queue chan<- event) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() && ctx.Err() == nil {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if 0 == len(line) {
+			continue
+		}
+
+		var e event
+		if err := json.Unmarshal(line, &e); err != nil {
+			logger.Printf("error parsing event from stdin: %s - %s\n", err.Error(), line)
+			continue
+		}
+		registerSiteURLs(e.URL)
+		if err := validateEvent(e); err != nil {
+			atomic.AddUint64(&eventInvalidCount, 1)
+			logger.Printf("skipping invalid job %d|%s|%s for %s from stdin: %s", e.Timestamp, e.Action, e.Instance, e.URL, err.Error())
+			continue
+		}
+
+		queueEvent(ctx, 0, queue, e)
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Printf("error reading events from stdin: %s\n", err.Error())
+	}
+
+	logger.Println("stdin closed, finishing queued events before shutdown")
+	shutdownWhenDrained()
+}
+
+// runAllEventsOnce runs every due event for every site a single time, then exits
+func runAllEventsOnce(ctx context.Context) {
+	ran, errored := 0, 0
+
+	siteList, err := getSites()
+	if err != nil {
+		logger.Printf("error retrieving sites: %s\n", err.Error())
+		closeRunLogs()
+		os.Exit(1)
+	}
+
+OuterLoop:
+	for _, site := range siteList {
+		site, ok := filterSite("runOnce", site)
+		if !ok {
 			continue
 		}
 
-		subcommand := []string{"cron-control", "orchestrate", "runner-only", "run", fmt.Sprintf("--timestamp=%d", event.Timestamp),
-			fmt.Sprintf("--action=%s", event.Action), fmt.Sprintf("--instance=%s", event.Instance), fmt.Sprintf("--url=%s", event.URL)}
+		events, err := getSiteEvents(site.URL)
+		if err != nil {
+			continue
+		}
+
+		sortEvents(events)
+		for _, event := range events {
+			if ctx.Err() != nil {
+				break OuterLoop
+			}
+
+			event.URL = eventURL(0, event, site)
+			event.NetworkID = site.NetworkID
+			if err := validateEvent(event); err != nil {
+				logger.Printf("runOnce skipping invalid job %d|%s|%s for %s: %s", event.Timestamp, event.Action, event.Instance, event.URL, err.Error())
+				continue
+			}
+			if err := validateEventURL(event, site.URL); err != nil {
+				logger.Printf("WARNING: runOnce skipping job %d|%s|%s with unsafe URL %q: %s", event.Timestamp, event.Action, event.Instance, event.URL, err.Error())
+				continue
+			}
+
+			for {
+				eventRan, err := runEvent(ctx, 1, event)
+				if !eventRan {
+					break
+				}
+				if willRetry(event, err) {
+					event.Attempts++
+					logger.Printf("runOnce retrying job %d|%s|%s for %s (attempt %d of %d)", event.Timestamp, event.Action, event.Instance, event.URL, event.Attempts, eventRetryCount)
+					time.Sleep(time.Duration(eventRetryDelay) * time.Millisecond)
+					continue
+				}
+
+				ran++
+				if err != nil {
+					errored++
+				}
+				break
+			}
+		}
+	}
+
+	logger.Printf("ran %d events, %d errors", ran, errored)
+	removeCheckpoint()
+	closeRunLogs()
+	os.Exit(0)
+}
+
+// closeRunLogs flushes and closes the files events are logged to, before exiting
+func closeRunLogs() {
+	closeGetEventsFailureLog()
+	closeEventLog()
+}
 
-		_, err := runWpCliCmd(subcommand)
+func runWpCliCmd(subcommand []string) (string, error) {
+	return runWpCliCmdTimeout(subcommand, 0)
+}
+
+// runWpCliCmdTimeout kills WP-CLI if it runs longer than `timeout`, `0` to wait indefinitely
+func runWpCliCmdTimeout(subcommand []string, timeout time.Duration) (string, error) {
+	return runWpCliCmdInput(subcommand, timeout, nil)
+}
+
+// runWpCliCmdInput is runWpCliCmdTimeout, writing `input` to WP-CLI's stdin
+func runWpCliCmdInput(subcommand []string, timeout time.Duration, input []byte) (string, error) {
+	// `--quiet`` included to prevent WP-CLI commands from generating invalid JSON
+	if "" == wpRunUser {
+		subcommand = append(subcommand, "--allow-root")
+	}
+	subcommand = append(subcommand, "--quiet", fmt.Sprintf("--path=%s", wpPath))
+	switch {
+	case "always" == wpColor:
+		subcommand = append(subcommand, "--color")
+	case "never" == wpColor || ("" == wpColor && wpNoColor):
+		subcommand = append(subcommand, "--no-color")
+	}
+	if "*" == wpCliSkipPlugins {
+		subcommand = append(subcommand, "--skip-plugins")
+	} else if "" != wpCliSkipPlugins {
+		subcommand = append(subcommand, fmt.Sprintf("--skip-plugins=%s", wpCliSkipPlugins))
+	}
+	if wpCliSkipThemes {
+		subcommand = append(subcommand, "--skip-themes")
+	}
+	if wpNetwork > 0 && !hasWpCliArg(subcommand, "--network=") {
+		subcommand = append(subcommand, fmt.Sprintf("--network=%d", wpNetwork))
+	}
+	if wpCliDebug {
+		subcommand = append(subcommand, "--debug")
+	}
 
-		if err == nil {
-			if heartbeatInt > 0 {
-				atomic.AddUint64(&eventRunSuccessCount, 1)
-			}
+	if logCliArgs {
+		logger.Printf("running WP-CLI %s", strings.Join(redactWpCliArgs(subcommand), " "))
+	}
 
-			if debug {
-				logger.Printf("runEvents-%d finished job %d|%s|%s for %s", workerID, event.Timestamp, event.Action, event.Instance, event.URL)
+	var wpCli *exec.Cmd
+	var wpOut, wpDebugOut []byte
+	var err error
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		wpCli = wpCliCommand(ctx, subcommand)
+		wpCli.Dir = eventRunCwd
+		if nil != input {
+			wpCli.Stdin = bytes.NewReader(input)
+		}
+		var stdout, stderr bytes.Buffer
+		wpCli.Stdout, wpCli.Stderr = &stdout, &stdout
+		if wpCliDebug {
+			// Debug output goes to stderr, keep it out of the command's JSON output
+			wpCli.Stderr = &stderr
+		}
+		if err = wpCli.Start(); err == nil {
+			stopGroupKill := func() {}
+			if isRunEventCmd(subcommand) {
+				stopGroupKill = killProcGroupOnTimeout(ctx, wpCli.Process.Pid)
 			}
-		} else if heartbeatInt > 0 {
-			atomic.AddUint64(&eventRunErrCount, 1)
+			err = wpCli.Wait()
+			stopGroupKill()
 		}
+		wpOut, wpDebugOut = stdout.Bytes(), stderr.Bytes()
+		err = classifyWpCliError(ctx, err, timeout, wpOut)
+		cancel()
 
-		waitForEpoch("runEvents", runEventsBreakSec)
-		if gRestart {
-			logger.Printf("exiting event worker ID %d\n", workerID)
+		exitCode, retryable := retryableExitCode(err)
+		if !retryable || attempt > wpCliRetryCount {
 			break
 		}
 
+		logger.Printf("WP-CLI exited with code %d, retrying (attempt %d of %d)", exitCode, attempt, wpCliRetryCount)
+		time.Sleep(time.Duration(wpCliRetryDelay) * time.Millisecond)
 	}
+	wpOutStr := ansiEscapeRegex.ReplaceAllString(string(wpOut), "")
 
-	// Mark this event worker as not running for graceful exit
-	gEventWorkersRunning[workerID-1] = false
-}
-
-func runWpCliCmd(subcommand []string) (string, error) {
-	// `--quiet`` included to prevent WP-CLI commands from generating invalid JSON
-	subcommand = append(subcommand, "--allow-root", "--quiet", fmt.Sprintf("--path=%s", wpPath))
-	if wpNetwork > 0 {
-		subcommand = append(subcommand, fmt.Sprintf("--network=%d", wpNetwork))
+	if 0 < len(wpDebugOut) {
+		if nil != wpCliDebugLogger {
+			wpCliDebugLogger.Printf("%s\n%s", strings.Join(redactWpCliArgs(subcommand), " "), wpDebugOut)
+		} else if err != nil {
+			logger.Printf("WP-CLI debug output for %s\n%s", strings.Join(redactWpCliArgs(subcommand), " "), wpDebugOut)
+		}
 	}
 
-	wpCli := exec.Command(wpCliPath, subcommand...)
-	wpOut, err := wpCli.CombinedOutput()
-	wpOutStr := string(wpOut)
-
 	if err != nil {
 		if debug {
 			logger.Printf("%s - %s", err, wpOutStr)
 			logger.Println(fmt.Sprintf("%+v", subcommand))
 		}
 
+		trackConsecutiveError()
 		return wpOutStr, err
 	}
+	atomic.StoreInt32(&consecutiveErrorCount, 0)
 
 	usage := wpCli.ProcessState.SysUsage().(*syscall.Rusage)
 
@@ -461,7 +2118,7 @@ func runWpCliCmd(subcommand []string) (string, error) {
 		}
 		if "" != job_info {
 			logger.Printf(
-				"%s: max rss: %0.0f KB : user time %0.2f sec : sys time %0.2f sec",
+				"%s: peak rss: %0.0f KB : user time %0.2f sec : sys time %0.2f sec",
 				job_info,
 				float64(usage.Maxrss)/1024,
 				float64(usage.Utime.Sec)+float64(usage.Utime.Usec)/1e6,
@@ -472,15 +2129,494 @@ func runWpCliCmd(subcommand []string) (string, error) {
 	return wpOutStr, nil
 }
 
+// redactWpCliArgs hides the values of `--network` and any -log-redact-args arguments
+func redactWpCliArgs(subcommand []string) []string {
+	prefixes := []string{"--network"}
+	for _, prefix := range strings.Split(logRedact, ",") {
+		if prefix = strings.TrimSpace(prefix); "" != prefix {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	redacted := make([]string, len(subcommand))
+	for i, arg := range subcommand {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(arg, prefix+"=") {
+				arg = prefix + "=***"
+				break
+			}
+		}
+		redacted[i] = arg
+	}
+
+	return redacted
+}
+
+func hasWpCliArg(subcommand []string, prefix string) bool {
+	for _, arg := range subcommand {
+		if strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func wpCliCommand(ctx context.Context, subcommand []string) *exec.Cmd {
+	args := append([]string{wpCliPath}, subcommand...)
+	if runEventWithPHP && isRunEventCmd(subcommand) {
+		// The shim takes the same arguments as `runner-only run`, skipping WP-CLI's bootstrap
+		args = append([]string{runEventPHPScript}, subcommand[len(runEventCmd):]...)
+	}
+	if "" != wpCliPHP {
+		args = append([]string{wpCliPHP}, args...)
+	}
+
+	var env []string
+	if "" != wpCliCacheDir {
+		env = append(env, "WP_CLI_CACHE_DIR="+wpCliCacheDir)
+	}
+	if isRunEventCmd(subcommand) {
+		env = append(env, eventRunEnv()...)
+	}
+	if "" != getEventsUserAgent && (hasCmdPrefix(subcommand, listEventsCmd) || hasCmdPrefix(subcommand, getInfoCmd)) {
+		env = append(env, "WP_CLI_HTTP_USER_AGENT="+getEventsUserAgent)
+	}
+	if isRunEventCmd(subcommand) {
+		args = resourceLimitArgs(append(niceArgs(), args...))
+	}
+
+	if "" != wpRunUser {
+		if 0 < len(env) {
+			// sudo resets the environment, so pass variables through `env`
+			args = append(append([]string{"env"}, env...), args...)
+		}
+		args = append([]string{"sudo", "-u", wpRunUser, "-n"}, args...)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if 0 < len(env) {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if isRunEventCmd(subcommand) {
+		setPdeathsig(cmd)
+		setProcGroup(cmd)
+	}
+	return cmd
+}
+
+var (
+	runEventCmd   = []string{"cron-control", "orchestrate", "runner-only", "run"}
+	listEventsCmd = []string{"cron-control", "orchestrate", "runner-only", "list-due-batch"}
+	getInfoCmd    = []string{"cron-control", "orchestrate", "runner-only", "get-info"}
+)
+
+func isRunEventCmd(subcommand []string) bool {
+	return hasCmdPrefix(subcommand, runEventCmd)
+}
+
+func hasCmdPrefix(subcommand []string, prefix []string) bool {
+	if len(subcommand) < len(prefix) {
+		return false
+	}
+	for i, arg := range prefix {
+		if subcommand[i] != arg {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateRunEventPHP checks that -wp-cli-php is set and is new enough to run the shim
+func validateRunEventPHP() {
+	if "" == wpCliPHP {
+		fmt.Println("-run-event-with-php requires -wp-cli-php")
+		usage()
+	}
+
+	out, err := exec.Command(wpCliPHP, "-r", "echo PHP_VERSION_ID;").Output()
+	if err != nil {
+		fmt.Printf("Could not determine the version of %s: %s\n", wpCliPHP, err.Error())
+		os.Exit(3)
+	}
+
+	versionID, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil || versionID < 70400 {
+		fmt.Printf("-run-event-with-php requires PHP 7.4 or later, %s reports %q\n", wpCliPHP, strings.TrimSpace(string(out)))
+		os.Exit(3)
+	}
+}
+
+// validateRunEventStdin checks the installed Cron Control's `runner-only run` accepts `--stdin`
+func validateRunEventStdin() {
+	out, err := runWpCliCmd([]string{"help", "cron-control", "orchestrate", "runner-only", "run"})
+	if err != nil {
+		fmt.Printf("Could not check -event-run-stdin support: %s\n", err.Error())
+		os.Exit(3)
+	}
+
+	if !strings.Contains(out, "--stdin") {
+		fmt.Println("-event-run-stdin requires a Cron Control version whose `runner-only run` command supports --stdin")
+		os.Exit(3)
+	}
+}
+
+func validateRunUser() {
+	if "" == wpRunUser {
+		return
+	}
+
+	if _, err := exec.LookPath("sudo"); err != nil {
+		fmt.Printf("Error for event run user: sudo not found: %s\n", err.Error())
+		os.Exit(3)
+	}
+
+	if out, err := exec.Command("sudo", "-u", wpRunUser, "-n", "true").CombinedOutput(); err != nil {
+		fmt.Printf("Error for event run user: cannot sudo to '%s': %s %s\n", wpRunUser, err.Error(), strings.TrimSpace(string(out)))
+		os.Exit(3)
+	}
+}
+
+func retryableExitCode(err error) (int, bool) {
+	exitErr, ok := err.(*WpCliExitError)
+	if !ok {
+		return 0, false
+	}
+
+	return exitErr.Code, gRetryExitCodes[exitErr.Code]
+}
+
+func parseBlogIDFilters() {
+	if "" == multisiteIncludeIDs && "" == multisiteExcludeIDs {
+		return
+	}
+
+	if !extraFieldRequested("blog_id") {
+		fmt.Println("-multisite-include-blog-ids and -multisite-exclude-blog-ids require -multisite-extra-fields=blog_id")
+		usage()
+	}
+
+	gIncludeBlogIDs = parseBlogIDs(multisiteIncludeIDs)
+	gExcludeBlogIDs = parseBlogIDs(multisiteExcludeIDs)
+}
+
+func extraFieldRequested(name string) bool {
+	for _, field := range strings.Split(multisiteExtraFields, ",") {
+		if name == strings.TrimSpace(field) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseBlogIDs(list string) map[int]struct{} {
+	if "" == list {
+		return nil
+	}
+
+	ids := make(map[int]struct{})
+	for _, id := range strings.Split(list, ",") {
+		blogID, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			fmt.Printf("Invalid blog ID '%s'\n", id)
+			usage()
+		}
+		ids[blogID] = struct{}{}
+	}
+
+	return ids
+}
+
+// siteBlogID is the site's `blog_id` extra field, `0` if it is missing or invalid
+func siteBlogID(s site) int {
+	blogID, _ := strconv.Atoi(s.ExtraFields["blog_id"])
+	return blogID
+}
+
+// blogIDAllowed applies -multisite-include-blog-ids and -multisite-exclude-blog-ids
+func blogIDAllowed(s site) bool {
+	if nil == gIncludeBlogIDs && nil == gExcludeBlogIDs {
+		return true
+	}
+
+	blogID, err := strconv.Atoi(s.ExtraFields["blog_id"])
+	if err != nil {
+		return nil == gIncludeBlogIDs
+	}
+
+	if _, found := gExcludeBlogIDs[blogID]; found {
+		return false
+	}
+	if nil != gIncludeBlogIDs {
+		_, found := gIncludeBlogIDs[blogID]
+		return found
+	}
+
+	return true
+}
+
+func parseRetryExitCodes() {
+	gRetryExitCodes = make(map[int]bool)
+	if "" == wpCliRetryExitCodes {
+		return
+	}
+
+	for _, code := range strings.Split(wpCliRetryExitCodes, ",") {
+		exitCode, err := strconv.Atoi(strings.TrimSpace(code))
+		if err != nil {
+			fmt.Printf("Invalid WP-CLI retry exit code '%s'\n", code)
+			usage()
+		}
+		gRetryExitCodes[exitCode] = true
+	}
+}
+
+func trackConsecutiveError() {
+	errCount := atomic.AddInt32(&consecutiveErrorCount, 1)
+	if maxConsecutiveErrors <= 0 || int(errCount) != maxConsecutiveErrors {
+		return
+	}
+
+	logger.Printf("CRITICAL: %d consecutive WP-CLI failures, scheduling restart\n", errCount)
+	atomic.StoreInt32(&gExitCode, 1)
+	// WP-CLI calls made while validating flags run before main() sets up gCancel
+	if nil != gCancel {
+		gCancel()
+	}
+}
+
+// currentRSS returns the runner's resident set size in bytes, `0` if it can't be read
+func currentRSS() uint64 {
+	raw, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(raw))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return pages * uint64(os.Getpagesize())
+}
+
+func watchMemory(ctx context.Context) {
+	if maxMemoryMB <= 0 || memoryPollInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(memoryPollInterval) * time.Second)
+	defer ticker.Stop()
+
+	var memStats runtime.MemStats
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		runtime.ReadMemStats(&memStats)
+		if heapMB := memStats.HeapAlloc / 1024 / 1024; heapMB > uint64(maxMemoryMB) {
+			logger.Printf("WARNING: heap size %d MB exceeds the %d MB limit, scheduling restart\n", heapMB, maxMemoryMB)
+			atomic.StoreInt32(&gExitCode, 1)
+			gCancel()
+			return
+		}
+	}
+}
+
+// Flags whose values are never printed by -config-dump
+var secretFlags = map[string]bool{"token": true, "multisite-api-token": true}
+
+func dumpConfig() {
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if secretFlags[f.Name] && "" != f.Value.String() {
+			config[f.Name] = "***"
+		} else {
+			config[f.Name] = f.Value.String()
+		}
+	})
+
+	buf, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		fmt.Printf("Error encoding the configuration: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Println(string(buf))
+	os.Exit(0)
+}
+
+// instanceStartupDelay spreads instances across the startup window by hashing the
+// hostname, so a host restarts with the same offset every time
+func instanceStartupDelay() time.Duration {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = instanceID
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(hostname))
+
+	return time.Duration(hash.Sum32()%uint32(startupDelay)) * time.Millisecond
+}
+
+// readFlagFiles loads values rendered to files by a secrets manager
+func readFlagFiles() {
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	readFlagFile := func(fileFlag string, fileName string, valueFlag string) string {
+		if setFlags[valueFlag] {
+			fmt.Printf("Only one of -%s and -%s may be set\n", valueFlag, fileFlag)
+			usage()
+		}
+
+		raw, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			fmt.Printf("Error reading -%s: %s\n", fileFlag, err.Error())
+			os.Exit(3)
+		}
+		return strings.TrimSpace(string(raw))
+	}
+
+	if "" != wpCliPathFile {
+		wpCliPath = readFlagFile("cli-file", wpCliPathFile, "cli")
+	}
+	if "" != wpPathFile {
+		wpPath = readFlagFile("wp-file", wpPathFile, "wp")
+	}
+	if "" != wpNetworkFile {
+		var err error
+		network := readFlagFile("network-id-file", wpNetworkFile, "network")
+		if wpNetwork, err = strconv.Atoi(network); err != nil {
+			fmt.Printf("Invalid network ID '%s' in %s\n", network, wpNetworkFile)
+			usage()
+		}
+	}
+}
+
+func setUpInstanceID() {
+	if "" != instanceID {
+		return
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	instanceID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+func setUpInstanceLabel() {
+	if "" == instanceLabel {
+		return
+	}
+
+	parts := strings.SplitN(instanceLabel, "=", 2)
+	if 2 != len(parts) || !instanceLabelKeyRegex.MatchString(parts[0]) || "" == parts[1] {
+		fmt.Printf("Invalid instance label '%s', expected key=value with a key of letters, digits and underscores\n", instanceLabel)
+		usage()
+	}
+
+	gLabels = map[string]string{parts[0]: parts[1]}
+}
+
+// setUpRunWorkersPerCPU sizes -workers-run from the CPU count, unless it was set explicitly
+func setUpRunWorkersPerCPU() {
+	if runWorkersPerCPU < 0 {
+		fmt.Printf("Invalid run workers per CPU %g\n", runWorkersPerCPU)
+		usage()
+	}
+	if 0 == runWorkersPerCPU {
+		return
+	}
+
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if "workers-run" == f.Name {
+			explicit = true
+		}
+	})
+	if explicit {
+		logger.Printf("WARNING: -run-workers-per-cpu is ignored as -workers-run is set to %d", numRunWorkers)
+		return
+	}
+
+	numRunWorkers = int(float64(runtime.NumCPU()) * runWorkersPerCPU)
+	if numRunWorkers < 1 {
+		numRunWorkers = 1
+	}
+	if numRunWorkersMax > 0 && numRunWorkers > numRunWorkersMax {
+		numRunWorkers = numRunWorkersMax
+	}
+
+	logger.Printf("Using %d event worker(s) for %d CPU(s) at %g per CPU", numRunWorkers, runtime.NumCPU(), runWorkersPerCPU)
+}
+
 func setUpLogger() {
+	logOpts := log.Ldate | log.Ltime
+	if logUTC {
+		logOpts |= log.LUTC
+	}
+	if logCaller {
+		logOpts |= log.Lshortfile
+	}
+	if logMicroseconds {
+		logOpts |= log.Lmicroseconds
+	}
+
 	if "os.Stdout" == logDest {
-		logger = &Logger{FileName: "os.Stdout", Type: Text}
+		logger = &Logger{FileName: "os.Stdout", Type: Text, InstanceID: instanceID, Flags: logOpts}
 	} else if "json" == strings.ToLower(logFormat) {
-		logger = &Logger{FileName: logDest, Type: JSON}
+		logger = &Logger{FileName: logDest, Type: JSON, InstanceID: instanceID, Flags: logOpts}
 	} else {
-		logger = &Logger{FileName: logDest, Type: Text}
+		logger = &Logger{FileName: logDest, Type: Text, InstanceID: instanceID, Flags: logOpts}
+	}
+	logger.SourceLocation = logSourceLoc
+	logger.Labels = gLabels
+	if logRedactSiteURLs {
+		logger.Redact = redactSiteURLs
 	}
 	logger.Init()
+
+	if wpCliDebug && "" != wpCliDebugLog {
+		wpCliDebugLogger = &Logger{FileName: wpCliDebugLog, Type: Text, InstanceID: instanceID, Flags: logOpts}
+		wpCliDebugLogger.Redact = logger.Redact
+		wpCliDebugLogger.Init()
+	}
+}
+
+// resolveWpCliPath falls back to the first existing -wpcli-path-fallback entry when
+// -cli does not exist, leaving validatePath to report the error if none do
+func resolveWpCliPath() {
+	if "" == wpCliPathFallback {
+		return
+	}
+
+	if _, err := os.Stat(wpCliPath); !os.IsNotExist(err) {
+		logger.Printf("Using WP-CLI at %s", wpCliPath)
+		return
+	}
+
+	for _, fallback := range filepath.SplitList(wpCliPathFallback) {
+		if "" == fallback {
+			continue
+		}
+		if _, err := os.Stat(fallback); !os.IsNotExist(err) {
+			logger.Printf("WP-CLI not found at %s, using %s", wpCliPath, fallback)
+			wpCliPath = fallback
+			return
+		}
+	}
 }
 
 func validatePath(path *string, label string) {
@@ -508,7 +2644,7 @@ func usage() {
 	os.Exit(3)
 }
 
-func waitForEpoch(whom string, epoch_sec int64) {
+func waitForEpoch(ctx context.Context, whom string, epoch_sec int64) {
 	tEpochNano := epoch_sec * time.Second.Nanoseconds()
 	tEpochDelta := tEpochNano - (time.Now().UnixNano() % tEpochNano)
 	if tEpochDelta < 1*time.Second.Nanoseconds() {
@@ -524,6 +2660,7 @@ func waitForEpoch(whom string, epoch_sec int64) {
 	}
 
 	tNextEpoch := time.Now().UnixNano() + tEpochDelta + gRandomDeltaMap[whom]
+	traceLog("%s waiting %s for the next epoch", whom, time.Duration(tNextEpoch-time.Now().UnixNano()))
 
 	// Sleep in 3sec intervals by default, less if we are running out of time
 	tMaxDelta := 3 * time.Second.Nanoseconds()
@@ -534,25 +2671,60 @@ func waitForEpoch(whom string, epoch_sec int64) {
 			// if we ever loop here for more than 2 full epochs, bail out
 			break
 		}
-		if gRestart {
-			return
-		}
 		tDelta = tNextEpoch - time.Now().UnixNano()
 		if tDelta > tMaxDelta {
 			tDelta = tMaxDelta
 		}
-		time.Sleep(time.Duration(tDelta))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(tDelta)):
+		}
 	}
 }
 
 func setupSignalHandler() {
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	if "" != eventRunEnvFile {
+		signal.Notify(sigChan, syscall.SIGHUP)
+	}
+	draining := false
 	for {
 		select {
 		case sig := <-sigChan:
+			if syscall.SIGHUP == sig {
+				loadEventRunEnv()
+				continue
+			}
+			if drainOnSigterm && syscall.SIGTERM == sig && !draining {
+				logger.Printf("caught termination signal %s, draining queued events before shutdown\n", sig)
+				draining = true
+				gDrain()
+				go shutdownWhenDrained()
+				continue
+			}
+
 			logger.Printf("caught termination signal %s, scheduling shutdown\n", sig)
-			gRestart = true
+			gCancel()
+		}
+	}
+}
+
+// shutdownWhenDrained waits until no sites are being processed and no events are
+// queued or running, then schedules the shutdown
+func shutdownWhenDrained() {
+	idleChecks := 0
+	for idleChecks < 2 {
+		time.Sleep(time.Second)
+
+		if 0 == atomic.LoadInt32(&gBusyRetrievers) && 0 >= atomic.LoadInt64(&gPendingEvents) && 0 == len(gEventTracker.InFlight()) {
+			idleChecks++
+		} else {
+			idleChecks = 0
 		}
 	}
+
+	logger.Println("all queued events finished, scheduling shutdown")
+	gCancel()
 }
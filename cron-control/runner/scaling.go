@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Number of consecutive idle scale intervals before a dynamic worker is retired
+const scaleDownIdleIntervals = 3
+
+// scaleWorkers grows the event worker pool while retrievers are waiting to queue
+// events, and retires the extra workers again once the queue stays empty
+func scaleWorkers(ctx context.Context, workerEvents <-chan event) {
+	dynamicWorkers := make([]int32, 0)
+	dynamicStops := make([]chan struct{}, 0)
+	idleIntervals := 0
+
+	ticker := time.NewTicker(time.Duration(scaleInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		depth := atomic.LoadInt64(&gQueuedEvents) + atomic.LoadInt64(&gPendingEvents)
+		if depth > 0 {
+			idleIntervals = 0
+			workerID := nextFreeWorkerID()
+			if 0 == workerID {
+				continue
+			}
+
+			stop := make(chan struct{})
+			dynamicWorkers = append(dynamicWorkers, int32(workerID))
+			dynamicStops = append(dynamicStops, stop)
+			gEventWorkersRunning[workerID-1] = true
+			logger.Printf("queue depth %d, adding event worker %d (%d dynamic)", depth, workerID, len(dynamicWorkers))
+			go runEvents(ctx, workerID, workerEvents, stop)
+			continue
+		}
+
+		if 0 == len(dynamicWorkers) {
+			continue
+		}
+
+		idleIntervals++
+		if idleIntervals < scaleDownIdleIntervals {
+			continue
+		}
+		idleIntervals = 0
+
+		last := len(dynamicWorkers) - 1
+		logger.Printf("queue idle, retiring event worker %d (%d dynamic)", dynamicWorkers[last], last)
+		close(dynamicStops[last])
+		dynamicWorkers, dynamicStops = dynamicWorkers[:last], dynamicStops[:last]
+	}
+}
+
+// nextFreeWorkerID returns the first unused worker slot, or 0 if the pool is full
+func nextFreeWorkerID() int {
+	for i, running := range gEventWorkersRunning {
+		if !running {
+			return i + 1
+		}
+	}
+
+	return 0
+}
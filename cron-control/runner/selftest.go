@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// selfTestFailedTotal counts the times -self-test-failures consecutive self-tests failed
+var selfTestFailedTotal uint64
+
+// watchSelfTest calls `get-info` every -self-test-interval to notice WordPress becoming
+// unreachable, restarting the runner after repeated failures with -self-test-restart-on-failure
+func watchSelfTest(ctx context.Context) {
+	if selfTestInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(selfTestInterval) * time.Second)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := getInstanceInfo()
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		logger.Printf("WARNING: self-test failed (%d of %d): %s\n", failures, selfTestFailures, err.Error())
+
+		if failures < selfTestFailures {
+			continue
+		}
+
+		atomic.AddUint64(&selfTestFailedTotal, 1)
+		failures = 0
+		if selfTestRestartOnFailure {
+			logger.Printf("CRITICAL: %d consecutive self-test failures, scheduling restart\n", selfTestFailures)
+			atomic.StoreInt32(&gExitCode, 1)
+			gCancel()
+			return
+		}
+		logger.Printf("ERROR: %d consecutive self-test failures\n", selfTestFailures)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readSiteListSource fetches the raw site list JSON from a file or HTTP(S) URL
+func readSiteListSource() (string, error) {
+	if !strings.HasPrefix(siteListSource, "http://") && !strings.HasPrefix(siteListSource, "https://") {
+		raw, err := ioutil.ReadFile(siteListSource)
+		if err != nil {
+			logger.Printf("error reading site list from %s: %s\n", siteListSource, err.Error())
+		}
+		return string(raw), err
+	}
+
+	return fetchSiteList(siteListSource, "")
+}
+
+// Site list API response reused for -site-cache-ttl
+var (
+	gSiteAPICache      string
+	gSiteAPICacheTime  time.Time
+	gSiteAPICacheMutex sync.Mutex
+)
+
+// readSiteListAPI fetches the raw site list JSON from -multisite-api-url, reusing
+// the last response for -site-cache-ttl seconds
+func readSiteListAPI() (string, error) {
+	gSiteAPICacheMutex.Lock()
+	defer gSiteAPICacheMutex.Unlock()
+
+	if siteCacheTTL > 0 && !gSiteAPICacheTime.IsZero() && time.Since(gSiteAPICacheTime) < time.Duration(siteCacheTTL)*time.Second {
+		return gSiteAPICache, nil
+	}
+
+	raw, err := fetchSiteList(multisiteAPIURL, multisiteAPIToken)
+	if err != nil {
+		return "", err
+	}
+
+	gSiteAPICache, gSiteAPICacheTime = raw, time.Now()
+	return raw, nil
+}
+
+// fetchSiteList GETs a JSON site list, authenticating with the bearer token if one is given
+func fetchSiteList(source string, token string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		logger.Printf("error fetching site list from %s: %s\n", source, err.Error())
+		return "", err
+	}
+	if "" != token {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: time.Duration(siteListSourceTimeout) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Printf("error fetching site list from %s: %s\n", source, err.Error())
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if http.StatusOK != resp.StatusCode {
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+		logger.Printf("error fetching site list from %s: %s\n", source, err.Error())
+		return "", err
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); "application/json" != mediaType {
+		err = fmt.Errorf("unexpected content type '%s'", resp.Header.Get("Content-Type"))
+		logger.Printf("error fetching site list from %s: %s\n", source, err.Error())
+		return "", err
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.Printf("error reading site list response from %s: %s\n", source, err.Error())
+	}
+	return string(raw), err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// postHeartbeatToSlack sends a heartbeat summary to -heartbeat-slack-webhook
+func postHeartbeatToSlack(summary string, errCount uint64) {
+	if "" == heartbeatSlackWebhook || (heartbeatSlackOnErrorOnly && 0 == errCount) {
+		return
+	}
+
+	labels := ""
+	for key, value := range gLabels {
+		labels += fmt.Sprintf(" %s=%s", key, value)
+	}
+
+	payload, err := json.Marshal(map[string]string{"text": fmt.Sprintf("Cron Control runner %s%s: %s", instanceID, labels, summary)})
+	if err != nil {
+		logger.Printf("error encoding Slack heartbeat: %s\n", err.Error())
+		return
+	}
+
+	client := &http.Client{Timeout: time.Duration(heartbeatSlackTimeout) * time.Second}
+	resp, err := client.Post(heartbeatSlackWebhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		logger.Printf("error posting heartbeat to Slack: %s\n", err.Error())
+		return
+	}
+	resp.Body.Close()
+
+	if http.StatusOK != resp.StatusCode {
+		logger.Printf("error posting heartbeat to Slack: unexpected status %s\n", resp.Status)
+	}
+}
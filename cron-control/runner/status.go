@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+type RunnerStatus struct {
+	LastHeartbeat    string `json:"last_heartbeat"`
+	UptimeSeconds    int64  `json:"uptime_seconds"`
+	SuccessTotal     uint64 `json:"success_total"`
+	ErrorTotal       uint64 `json:"error_total"`
+	ActiveRetrievers int32  `json:"active_retrievers"`
+	ActiveWorkers    int    `json:"active_workers"`
+	QueueDepth       int64  `json:"queue_depth"`
+	SiteCount        int    `json:"site_count"`
+	RestartPending   bool   `json:"restart_pending"`
+	WPVersion        string `json:"wp_version"`
+	SelfTestFailed   uint64 `json:"self_test_failed_total"`
+}
+
+var gStartTime = time.Now()
+
+// Event run totals up to the last heartbeat, which resets the per-heartbeat counters
+var (
+	eventRunSuccessTotal uint64
+	eventRunErrTotal     uint64
+)
+
+// reportDuration is the -report-interval, falling back to -heartbeat
+func reportDuration() time.Duration {
+	if reportInterval > 0 {
+		return time.Duration(reportInterval) * time.Second
+	}
+	return time.Duration(heartbeatInt) * time.Second
+}
+
+// reportPeriodically refreshes the status file between heartbeats with -report-interval,
+// without resetting counters or logging a heartbeat line
+func reportPeriodically(ctx context.Context) {
+	if reportInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(reportDuration())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			writeStatusFile(false)
+		}
+	}
+}
+
+func writeStatusFile(restartPending bool) {
+	if "" == statusFile {
+		return
+	}
+
+	successTotal := atomic.LoadUint64(&eventRunSuccessTotal) + atomic.LoadUint64(&eventRunSuccessCount)
+	errTotal := atomic.LoadUint64(&eventRunErrTotal) + atomic.LoadUint64(&eventRunErrCount)
+
+	gLastSiteListMutex.Lock()
+	siteCount := len(gLastSiteList)
+	gLastSiteListMutex.Unlock()
+
+	gInfoCacheMutex.Lock()
+	wpVersion := gInfoCache.Version
+	gInfoCacheMutex.Unlock()
+
+	now := time.Now()
+	status := RunnerStatus{
+		LastHeartbeat:    now.UTC().Format(time.RFC3339),
+		UptimeSeconds:    int64(now.Sub(gStartTime).Seconds()),
+		SuccessTotal:     successTotal,
+		ErrorTotal:       errTotal,
+		ActiveRetrievers: atomic.LoadInt32(&gBusyRetrievers),
+		ActiveWorkers:    len(gEventTracker.InFlight()),
+		QueueDepth:       atomic.LoadInt64(&gQueuedEvents) + atomic.LoadInt64(&gPendingEvents),
+		SiteCount:        siteCount,
+		RestartPending:   restartPending,
+		WPVersion:        wpVersion,
+		SelfTestFailed:   atomic.LoadUint64(&selfTestFailedTotal),
+	}
+
+	buf, err := json.Marshal(status)
+	if err == nil {
+		err = writeFileAtomic(statusFile, buf)
+	}
+	if err != nil {
+		logger.Printf("error writing status file %s: %s\n", statusFile, err.Error())
+	}
+}
+
+type HeartbeatEntry struct {
+	Time            string            `json:"time"`
+	InstanceID      string            `json:"instance"`
+	EventsSucceeded uint64            `json:"events_succeeded"`
+	EventsErrored   uint64            `json:"events_errored"`
+	EventsDropped   uint64            `json:"events_dropped"`
+	EventsInvalid   uint64            `json:"events_invalid"`
+	SitesRejected   uint64            `json:"sites_scheme_rejected"`
+	Rate5m          float64           `json:"rate_5m"`
+	Rate15m         float64           `json:"rate_15m"`
+	Rate60m         float64           `json:"rate_60m"`
+	WorkerSucceeded []uint64          `json:"workers,omitempty"`
+	Actions         []ActionCount     `json:"actions,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// writeHeartbeatFile replaces the heartbeat file with the latest heartbeat
+func writeHeartbeatFile(entry HeartbeatEntry) {
+	if "" == heartbeatFile {
+		return
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		logger.Printf("error encoding heartbeat: %s\n", err.Error())
+		return
+	}
+
+	f, err := os.OpenFile(heartbeatFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		logger.Printf("error opening heartbeat file %s: %s\n", heartbeatFile, err.Error())
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(buf, '\n')); err != nil {
+		logger.Printf("error writing heartbeat file %s: %s\n", heartbeatFile, err.Error())
+	}
+}
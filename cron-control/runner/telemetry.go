@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+const channelTelemetrySampleInt = 5 * time.Second
+
+var (
+	eventsSentTotal     uint64
+	eventsReceivedTotal uint64
+)
+
+// channelTelemetry samples the retriever-to-worker event channel and logs its
+// throughput every heartbeat interval. The channel is unbuffered and never fills,
+// so the senders blocked in queueEvent and the events waiting for a worker are sampled instead.
+func channelTelemetry(ctx context.Context) {
+	reportInt := time.Duration(heartbeatInt) * time.Second
+	if reportInt <= 0 {
+		reportInt = 60 * time.Second
+	}
+
+	sample := time.NewTicker(channelTelemetrySampleInt)
+	defer sample.Stop()
+	report := time.NewTicker(reportInt)
+	defer report.Stop()
+
+	var samples int
+	var waitingSum, pendingSum int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sample.C:
+			waitingSum += atomic.LoadInt64(&gQueuedEvents)
+			pendingSum += atomic.LoadInt64(&gPendingEvents)
+			samples++
+		case <-report.C:
+			var waitingAvg, pendingAvg float64
+			if samples > 0 {
+				waitingAvg = float64(waitingSum) / float64(samples)
+				pendingAvg = float64(pendingSum) / float64(samples)
+			}
+			logger.Printf("eventsChannel senders_waiting=%d senders_waiting_avg=%0.1f events_pending_avg=%0.1f events_sent_total=%d events_received_total=%d",
+				atomic.LoadInt64(&gQueuedEvents), waitingAvg, pendingAvg, atomic.LoadUint64(&eventsSentTotal), atomic.LoadUint64(&eventsReceivedTotal))
+			samples, waitingSum, pendingSum = 0, 0, 0
+		}
+	}
+}
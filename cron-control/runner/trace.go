@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+)
+
+// traceLog logs internal goroutine and channel activity with -trace, prefixed with the
+// goroutine ID so interleaved messages can be correlated
+func traceLog(format string, v ...interface{}) {
+	if !trace {
+		return
+	}
+
+	logger.Printf("trace g%d %s", goroutineID(), fmt.Sprintf(format, v...))
+}
+
+// goroutineID parses the ID from the "goroutine N [running]:" header of runtime.Stack
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		buf = buf[:i]
+	}
+
+	var id uint64
+	fmt.Sscanf(string(buf), "%d", &id)
+	return id
+}